@@ -5,10 +5,10 @@ go 1.18
 require (
 	github.com/aws/aws-sdk-go v1.44.60
 	github.com/mackerelio/go-mackerel-plugin v0.1.3
+	github.com/mackerelio/golib v1.2.1
+	golang.org/x/text v0.3.7
 )
 
 require (
 	github.com/jmespath/go-jmespath v0.4.0 // indirect
-	github.com/mackerelio/golib v1.2.1 // indirect
-	golang.org/x/text v0.3.7 // indirect
 )
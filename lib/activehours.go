@@ -0,0 +1,58 @@
+package mpawsecs
+
+import (
+	"fmt"
+	"strings"
+	"time"
+	// the timezones of -active-timezone on the hosts without zoneinfo such as Windows
+	_ "time/tzdata"
+)
+
+// activeHours is a daily window such as 09:00-18:00 in a timezone.
+// A window whose end is before its start spans midnight, e.g. 22:00-06:00.
+type activeHours struct {
+	start    time.Duration
+	end      time.Duration
+	location *time.Location
+}
+
+func parseClock(s string) (time.Duration, error) {
+	t, err := time.Parse("15:04", strings.TrimSpace(s))
+	if err != nil {
+		return 0, err
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+// parseActiveHours parses "HH:MM-HH:MM" in the timezone (the local one when empty)
+func parseActiveHours(s, timezone string) (*activeHours, error) {
+	startEnd := strings.SplitN(s, "-", 2)
+	if len(startEnd) != 2 {
+		return nil, fmt.Errorf("invalid active hours %q: expected HH:MM-HH:MM", s)
+	}
+	start, err := parseClock(startEnd[0])
+	if err != nil {
+		return nil, fmt.Errorf("invalid active hours %q: %s", s, err)
+	}
+	end, err := parseClock(startEnd[1])
+	if err != nil {
+		return nil, fmt.Errorf("invalid active hours %q: %s", s, err)
+	}
+	location := time.Local
+	if timezone != "" {
+		location, err = time.LoadLocation(timezone)
+		if err != nil {
+			return nil, fmt.Errorf("invalid active timezone %q: %s", timezone, err)
+		}
+	}
+	return &activeHours{start: start, end: end, location: location}, nil
+}
+
+func (h activeHours) contains(t time.Time) bool {
+	t = t.In(h.location)
+	clock := time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute + time.Duration(t.Second())*time.Second
+	if h.start <= h.end {
+		return h.start <= clock && clock < h.end
+	}
+	return h.start <= clock || clock < h.end
+}
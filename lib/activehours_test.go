@@ -0,0 +1,69 @@
+package mpawsecs
+
+import (
+	"testing"
+	"time"
+)
+
+func TestActiveHoursContains(t *testing.T) {
+	utc := func(hour, min int) time.Time {
+		return time.Date(2024, 4, 1, hour, min, 0, 0, time.UTC)
+	}
+
+	tests := []struct {
+		name     string
+		hours    string
+		timezone string
+		t        time.Time
+		want     bool
+	}{
+		{name: "inside", hours: "09:00-18:00", timezone: "UTC", t: utc(12, 0), want: true},
+		{name: "at the start", hours: "09:00-18:00", timezone: "UTC", t: utc(9, 0), want: true},
+		{name: "at the end", hours: "09:00-18:00", timezone: "UTC", t: utc(18, 0), want: false},
+		{name: "before", hours: "09:00-18:00", timezone: "UTC", t: utc(8, 59), want: false},
+		{name: "after", hours: "09:00-18:00", timezone: "UTC", t: utc(23, 0), want: false},
+		{name: "spanning midnight before it", hours: "22:00-06:00", timezone: "UTC", t: utc(23, 30), want: true},
+		{name: "spanning midnight after it", hours: "22:00-06:00", timezone: "UTC", t: utc(5, 59), want: true},
+		{name: "spanning midnight outside", hours: "22:00-06:00", timezone: "UTC", t: utc(12, 0), want: false},
+		// 01:00 UTC is 10:00 in Tokyo
+		{name: "timezone inside", hours: "09:00-18:00", timezone: "Asia/Tokyo", t: utc(1, 0), want: true},
+		// 12:00 UTC is 21:00 in Tokyo
+		{name: "timezone outside", hours: "09:00-18:00", timezone: "Asia/Tokyo", t: utc(12, 0), want: false},
+		// 13:30 UTC is 09:30 EDT, but 08:30 EST of a month earlier
+		{name: "daylight saving time", hours: "09:00-17:00", timezone: "America/New_York", t: utc(13, 30), want: true},
+		{name: "standard time", hours: "09:00-17:00", timezone: "America/New_York", t: utc(13, 30).AddDate(0, -1, 0), want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h, err := parseActiveHours(tt.hours, tt.timezone)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := h.contains(tt.t); got != tt.want {
+				t.Errorf("contains(%s) = %v, want %v", tt.t, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseActiveHours(t *testing.T) {
+	tests := []struct {
+		hours    string
+		timezone string
+		wantErr  bool
+	}{
+		{hours: "09:00-18:00"},
+		{hours: " 9:30 - 17:45 ", timezone: "Europe/London"},
+		{hours: "09:00", wantErr: true},
+		{hours: "09:00-25:00", wantErr: true},
+		{hours: "nine-five", wantErr: true},
+		{hours: "09:00-18:00", timezone: "Mars/Olympus_Mons", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.hours+" "+tt.timezone, func(t *testing.T) {
+			if _, err := parseActiveHours(tt.hours, tt.timezone); (err != nil) != tt.wantErr {
+				t.Errorf("parseActiveHours() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
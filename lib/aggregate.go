@@ -0,0 +1,185 @@
+package mpawsecs
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+
+	mp "github.com/mackerelio/go-mackerel-plugin"
+)
+
+// the metrics aggregated over the services of the cluster
+var aggregatedMetrics = []string{"CPUUtilization", "MemoryUtilization"}
+
+// how the values of a metric are rolled up over the services
+const (
+	aggregateSum = "sum"
+	aggregateAvg = "avg"
+)
+
+// defaultRollupAggregations are how the task counts are rolled up over the services with
+// EmitServiceRollup, summed into the totals of the cluster by default. The utilization is
+// left to addServiceAggregates, which reports both its sum and its average.
+var defaultRollupAggregations = map[string]string{
+	"TaskRunning": aggregateSum,
+	"TaskPending": aggregateSum,
+	"TaskDesired": aggregateSum,
+}
+
+// parseRollupAggregations parses comma separated overrides of defaultRollupAggregations
+// such as "TaskDesired=avg,TaskPending=avg"
+func parseRollupAggregations(s string) (map[string]string, error) {
+	aggregations := make(map[string]string)
+	if s == "" {
+		return aggregations, nil
+	}
+	for _, entry := range strings.Split(s, ",") {
+		metric, aggregation, ok := strings.Cut(strings.TrimSpace(entry), "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid rollup aggregation %q: expected metric=sum or metric=avg", entry)
+		}
+		if _, ok := defaultRollupAggregations[metric]; !ok {
+			return nil, fmt.Errorf("invalid rollup aggregation %q: unknown metric %q", entry, metric)
+		}
+		if aggregation != aggregateSum && aggregation != aggregateAvg {
+			return nil, fmt.Errorf("invalid rollup aggregation %q: expected metric=sum or metric=avg", entry)
+		}
+		aggregations[metric] = aggregation
+	}
+	return aggregations, nil
+}
+
+// rollupAggregation returns how the metric is rolled up over the services
+func (p ECSPlugin) rollupAggregation(metric string) string {
+	if a, ok := p.RollupAggregations[metric]; ok {
+		return a
+	}
+	return defaultRollupAggregations[metric]
+}
+
+// addServiceRollup reports the metrics of defaultRollupAggregations rolled up over the
+// services as "ServiceRollup<metric>". The services without a value of a metric are left
+// out of its rollup, and a metric of no service is not reported.
+func (p ECSPlugin) addServiceRollup(stat map[string]float64, stats []map[string]float64) {
+	for metric := range defaultRollupAggregations {
+		var sum float64
+		var n int
+		for _, s := range stats {
+			v, ok := s[metric]
+			// a NaN is a missing value to be filled
+			if !ok || math.IsNaN(v) {
+				continue
+			}
+			sum += v
+			n++
+		}
+		if n == 0 {
+			continue
+		}
+		if p.rollupAggregation(metric) == aggregateAvg {
+			sum /= float64(n)
+		}
+		stat["ServiceRollup"+metric] = sum
+	}
+}
+
+// rollupGraph returns the graph of the rolled up metrics, which is of the unit of
+// the metrics unless their aggregation is overridden, e.g. an average of task counts.
+func (p ECSPlugin) rollupGraph(label, unit string, metrics []mp.Metrics) mp.Graphs {
+	for i, m := range metrics {
+		if p.rollupAggregation(m.Name) != defaultRollupAggregations[m.Name] {
+			unit = "float"
+		}
+		metrics[i].Name = "ServiceRollup" + m.Name
+	}
+	return mp.Graphs{Label: label, Unit: unit, Metrics: metrics}
+}
+
+// addServiceAggregates reports the sum and the average over the services of the Average of
+// their CPU and memory utilization, and the TopN services of the most CPU utilization.
+// names and stats are the names and the stats of the services before nesting.
+func (p ECSPlugin) addServiceAggregates(stat map[string]float64, names []string, stats []map[string]float64) {
+	type service struct {
+		name string
+		cpu  float64
+	}
+	var top []service
+	for _, m := range aggregatedMetrics {
+		var sum float64
+		var n int
+		for i, s := range stats {
+			v, ok := s[m+metricsTypeAverage]
+			// a NaN is a missing value to be filled
+			if !ok || math.IsNaN(v) {
+				continue
+			}
+			sum += v
+			n++
+			if m == "CPUUtilization" {
+				top = append(top, service{names[i], v})
+			}
+		}
+		if n == 0 {
+			continue
+		}
+		stat["Service"+m+metricsTypeSum] = sum
+		stat["Service"+m+metricsTypeAverage] = sum / float64(n)
+	}
+
+	if p.TopN == 0 {
+		return
+	}
+	sort.Slice(top, func(i, j int) bool {
+		if top[i].cpu != top[j].cpu {
+			return top[i].cpu > top[j].cpu
+		}
+		return top[i].name < top[j].name
+	})
+	if len(top) > p.TopN {
+		top = top[:p.TopN]
+	}
+	for _, s := range top {
+		stat["TopServiceCPUUtilization."+s.name+".CPUUtilization"] = s.cpu
+	}
+}
+
+func (p ECSPlugin) serviceAggregateGraphDefinition() map[string]mp.Graphs {
+	labelPrefix := p.labelPrefix()
+	graphs := map[string]mp.Graphs{
+		"ServiceUtilizationAverage": {
+			Label: labelPrefix + " Service Utilization Average",
+			Unit:  "percentage",
+			Metrics: []mp.Metrics{
+				{Name: "ServiceCPUUtilizationAverage", Label: "CPU"},
+				{Name: "ServiceMemoryUtilizationAverage", Label: "Memory"},
+			},
+		},
+		// the sum of percentages exceeds 100
+		"ServiceUtilizationSum": {
+			Label: labelPrefix + " Service Utilization Sum",
+			Unit:  "float",
+			Metrics: []mp.Metrics{
+				{Name: "ServiceCPUUtilizationSum", Label: "CPU"},
+				{Name: "ServiceMemoryUtilizationSum", Label: "Memory"},
+			},
+		},
+	}
+	if p.EmitServiceRollup {
+		graphs["ServiceRollupTask"] = p.rollupGraph(labelPrefix+" Service Rollup Task", "integer", []mp.Metrics{
+			{Name: "TaskRunning", Label: "Running"},
+			{Name: "TaskPending", Label: "Pending"},
+			{Name: "TaskDesired", Label: "Desired"},
+		})
+	}
+	if p.TopN > 0 {
+		graphs["TopServiceCPUUtilization.#"] = mp.Graphs{
+			Label: labelPrefix + " Top Service CPUUtilization",
+			Unit:  "percentage",
+			Metrics: []mp.Metrics{
+				{Name: "CPUUtilization", Label: "%1"},
+			},
+		}
+	}
+	return graphs
+}
@@ -0,0 +1,134 @@
+package mpawsecs
+
+import (
+	"math"
+	"reflect"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/service/ecs"
+)
+
+func TestParseRollupAggregations(t *testing.T) {
+	tests := []struct {
+		s       string
+		want    map[string]string
+		wantErr bool
+	}{
+		{s: "", want: map[string]string{}},
+		{s: "TaskDesired=avg", want: map[string]string{"TaskDesired": aggregateAvg}},
+		{s: "TaskDesired=avg, TaskPending=avg", want: map[string]string{"TaskDesired": aggregateAvg, "TaskPending": aggregateAvg}},
+		{s: "TaskDesired", wantErr: true},
+		{s: "TaskDesired=max", wantErr: true},
+		{s: "NetworkRxBytes=sum", wantErr: true},
+		// the utilization is of addServiceAggregates
+		{s: "CPUUtilizationAverage=sum", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.s, func(t *testing.T) {
+			got, err := parseRollupAggregations(tt.s)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseRollupAggregations() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseRollupAggregations() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestServiceRollup(t *testing.T) {
+	cw := &fakeCloudWatch{points: map[string][]point{
+		"web CPUUtilization Average":       minutesAgo(60, 60),
+		"web MemoryUtilization Average":    minutesAgo(40, 40),
+		"worker CPUUtilization Average":    minutesAgo(20, 20),
+		"worker MemoryUtilization Average": minutesAgo(80, 80),
+		// batch has no datapoints of its utilization
+	}}
+	e := &fakeECS{services: map[string]*ecs.Service{
+		"web":    newService("web", 4, 1, 5),
+		"worker": newService("worker", 2, 0, 2),
+		"batch":  newService("batch", 0, 0, 1),
+	}}
+
+	tests := []struct {
+		name         string
+		aggregations map[string]string
+		want         map[string]float64
+		wantUnits    map[string]string
+	}{
+		{
+			name: "counts summed",
+			want: map[string]float64{
+				"ServiceRollupTaskRunning": 6,
+				"ServiceRollupTaskPending": 1,
+				"ServiceRollupTaskDesired": 8,
+			},
+			wantUnits: map[string]string{"ServiceRollupTask": "integer"},
+		},
+		{
+			name:         "overridden",
+			aggregations: map[string]string{"TaskDesired": aggregateAvg},
+			want: map[string]float64{
+				"ServiceRollupTaskRunning": 6,
+				"ServiceRollupTaskPending": 1,
+				"ServiceRollupTaskDesired": 8.0 / 3,
+			},
+			wantUnits: map[string]string{"ServiceRollupTask": "float"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newTestPlugin(t, cw, e)
+			p.ServiceName = "web,worker,batch"
+			p.Statistics = []string{metricsTypeAverage}
+			p.EmitServiceRollup = true
+			p.RollupAggregations = tt.aggregations
+
+			stat, err := p.FetchMetrics()
+			if err != nil {
+				t.Fatal(err)
+			}
+			for key, want := range tt.want {
+				if got, ok := stat[key]; !ok || math.Abs(got-want) > 1e-9 {
+					t.Errorf("%s = %v (reported: %v), want %v", key, got, ok, want)
+				}
+			}
+			// the utilization is averaged by addServiceAggregates alone
+			if v, ok := stat["ServiceRollupCPUUtilizationAverage"]; ok {
+				t.Errorf("ServiceRollupCPUUtilizationAverage = %v, want none", v)
+			}
+			if got := stat["ServiceCPUUtilizationAverage"]; got != 40 {
+				t.Errorf("ServiceCPUUtilizationAverage = %v, want 40", got)
+			}
+			graphs := p.GraphDefinition()
+			if _, ok := graphs["ServiceRollupUtilization"]; ok {
+				t.Errorf("GraphDefinition() has ServiceRollupUtilization")
+			}
+			for key, want := range tt.wantUnits {
+				if got := graphs[key].Unit; got != want {
+					t.Errorf("unit of %s = %q, want %q", key, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestServiceRollupDisabled(t *testing.T) {
+	e := &fakeECS{services: map[string]*ecs.Service{
+		"web":    newService("web", 4, 1, 5),
+		"worker": newService("worker", 2, 0, 2),
+	}}
+	p := newTestPlugin(t, &fakeCloudWatch{}, e)
+	p.ServiceName = "web,worker"
+
+	stat, err := p.FetchMetrics()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, ok := stat["ServiceRollupTaskRunning"]; ok {
+		t.Errorf("ServiceRollupTaskRunning = %v, want none", v)
+	}
+	if _, ok := p.GraphDefinition()["ServiceRollupTask"]; ok {
+		t.Errorf("GraphDefinition() has ServiceRollupTask")
+	}
+}
@@ -0,0 +1,68 @@
+package mpawsecs
+
+import (
+	"log"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/applicationautoscaling"
+	mp "github.com/mackerelio/go-mackerel-plugin"
+)
+
+// DescribeScalableTargets accepts up to 50 resource IDs at once
+const describeScalableTargetsLimit = 50
+
+// fetchScalableTargets reports the min and max capacity of the services registered
+// to Application Auto Scaling, and their desired count alongside, into their stat of stats.
+func (p ECSPlugin) fetchScalableTargets(stats map[string]map[string]float64) {
+	var ids []string
+	for name := range stats {
+		ids = append(ids, "service/"+p.ClusterName+"/"+name)
+	}
+	sort.Strings(ids)
+
+	for i := 0; i < len(ids); i += describeScalableTargetsLimit {
+		end := i + describeScalableTargetsLimit
+		if end > len(ids) {
+			end = len(ids)
+		}
+		input := &applicationautoscaling.DescribeScalableTargetsInput{
+			ServiceNamespace:  aws.String(applicationautoscaling.ServiceNamespaceEcs),
+			ScalableDimension: aws.String(applicationautoscaling.ScalableDimensionEcsServiceDesiredCount),
+			ResourceIds:       aws.StringSlice(ids[i:end]),
+		}
+		err := p.AutoScaling.DescribeScalableTargetsPagesWithContext(p.context(), input, func(page *applicationautoscaling.DescribeScalableTargetsOutput, lastPage bool) bool {
+			for _, t := range page.ScalableTargets {
+				id := aws.StringValue(t.ResourceId)
+				stat, ok := stats[id[strings.LastIndex(id, "/")+1:]]
+				if !ok {
+					continue
+				}
+				stat["AutoscalingMinCapacity"] = float64(aws.Int64Value(t.MinCapacity))
+				stat["AutoscalingMaxCapacity"] = float64(aws.Int64Value(t.MaxCapacity))
+				if desired, ok := stat["TaskDesired"]; ok {
+					stat["AutoscalingDesiredCount"] = desired
+				}
+			}
+			return true
+		})
+		if err != nil {
+			log.Printf("failed to describe the scalable targets %v: %s", ids[i:end], err)
+		}
+	}
+}
+
+func (p ECSPlugin) autoscalingGraphDefinition() map[string]mp.Graphs {
+	return map[string]mp.Graphs{
+		"Autoscaling": {
+			Label: p.labelPrefix() + " Autoscaling Capacity",
+			Unit:  "integer",
+			Metrics: []mp.Metrics{
+				{Name: "AutoscalingDesiredCount", Label: "Desired"},
+				{Name: "AutoscalingMinCapacity", Label: "Min"},
+				{Name: "AutoscalingMaxCapacity", Label: "Max"},
+			},
+		},
+	}
+}
@@ -1,17 +1,60 @@
 package mpawsecs
 
 import (
+	"context"
 	"errors"
 	"flag"
+	"fmt"
+	"io"
 	"log"
+	"math"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"regexp"
+	"runtime"
+	"sort"
+	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/client"
 	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
+	"github.com/aws/aws-sdk-go/aws/ec2metadata"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/applicationautoscaling"
+	"github.com/aws/aws-sdk-go/service/applicationautoscaling/applicationautoscalingiface"
 	"github.com/aws/aws-sdk-go/service/cloudwatch"
+	"github.com/aws/aws-sdk-go/service/cloudwatch/cloudwatchiface"
+	"github.com/aws/aws-sdk-go/service/ecs"
+	"github.com/aws/aws-sdk-go/service/ecs/ecsiface"
+	"github.com/aws/aws-sdk-go/service/elbv2"
+	"github.com/aws/aws-sdk-go/service/elbv2/elbv2iface"
+	"github.com/aws/aws-sdk-go/service/sts"
+	"github.com/aws/aws-sdk-go/service/sts/stsiface"
 	mp "github.com/mackerelio/go-mackerel-plugin"
+	"golang.org/x/text/cases"
+	"golang.org/x/text/language"
+)
+
+const (
+	// default period of the datapoints fetched from CloudWatch
+	defaultPeriod = 60 * time.Second
+	// default minimum window to look back for the datapoints
+	defaultLookback = 180 * time.Second
+	// default timeout of an AWS API request
+	defaultTimeout = 30 * time.Second
+	// timeout of the region lookup from the EC2 instance metadata, which never answers off EC2
+	metadataTimeout = time.Second
+	// default time to cache the services listed with the ECS API
+	defaultDiscoveryCacheTTL = 5 * time.Minute
+	// default max number of retries of an AWS API request
+	defaultMaxRetries = 3
 )
 
 const (
@@ -20,8 +63,60 @@ const (
 	metricsTypeMinimum     = "Minimum"
 	metricsTypeMaximum     = "Maximum"
 	metricsTypeSampleCount = "SampleCount"
+	metricsTypeSum         = "Sum"
+)
+
+const (
+	launchTypeEC2     = "ec2"
+	launchTypeFargate = "fargate"
+)
+
+// where the task counts of the services are taken from
+const (
+	taskCountECS        = "ecs"
+	taskCountCloudWatch = "cloudwatch"
+)
+
+// how the metrics without datapoints in the window are reported
+const (
+	fillSkip = "skip"
+	fillZero = "zero"
+	fillLast = "last"
 )
 
+// targetWildcard nests the graphs of each of multiple clusters or services under its name
+const targetWildcard = "#."
+
+// dimensionScope is the set of dimensions a metric is queried with
+type dimensionScope int
+
+const (
+	// ClusterName, and ServiceName or TaskDefinitionFamily when given
+	scopeService dimensionScope = iota
+	// ClusterName only, for the metrics published per cluster
+	scopeCluster
+)
+
+// metricRoute is where a metric is queried from
+type metricRoute struct {
+	// AWS/ECS when empty
+	namespace string
+	scope     dimensionScope
+}
+
+// metricRoutes routes each metric. Unlisted metrics are queried from AWS/ECS with scopeService.
+var metricRoutes = map[string]metricRoute{
+	"CPUReservation":    {scope: scopeCluster},
+	"MemoryReservation": {scope: scopeCluster},
+	"GPUReservation":    {scope: scopeCluster},
+}
+
+func init() {
+	for _, m := range append(containerInsights, taskFamilyInsights...) {
+		metricRoutes[m.name] = metricRoute{namespace: containerInsightsNamespace}
+	}
+}
+
 type metrics struct {
 	Name string
 	Type string
@@ -29,13 +124,88 @@ type metrics struct {
 
 // ECSPlugin mackerel plugin for ecs
 type ECSPlugin struct {
-	AccessKeyID     string
-	SecretAccessKey string
-	CloudWatch      *cloudwatch.CloudWatch
-	ClusterName     string
-	ServiceName     string
-	Prefix          string
-	Region          string
+	AccessKeyID          string
+	SecretAccessKey      string
+	Profile              string
+	AssumeRoleARN        string
+	ExternalID           string
+	CloudWatch           cloudwatchiface.CloudWatchAPI
+	ECS                  ecsiface.ECSAPI
+	ELBV2                elbv2iface.ELBV2API
+	AutoScaling          applicationautoscalingiface.ApplicationAutoScalingAPI
+	STS                  stsiface.STSAPI
+	ClusterName          string
+	ServiceName          string
+	TaskDefinitionFamily string
+	Prefix               string
+	PrefixMap            map[string]string
+	Region               string
+	Namespace            string
+	ExtraDimensions      []*cloudwatch.Dimension
+	LaunchType           string
+	FallbackRegion       string
+	Endpoint             string
+	ECSEndpoint          string
+	EndpointMapFile      string
+	MetricStreamFile     string
+	TargetGroupARN       string
+	Period               time.Duration
+	Lookback             time.Duration
+	MaxRetries           int
+	RetryThrottleDelay   time.Duration
+	RetryMaxDelay        time.Duration
+	Timeout              time.Duration
+	DatapointLag         time.Duration
+	ZeroGrace            time.Duration
+	FetchDeadline        time.Duration
+	DiscoveryCacheTTL    time.Duration
+	Statistics           []string
+	ExtendedStatistics   []string
+	MaxConcurrency       int
+	TopN                 int
+	EmitServiceRollup    bool
+	RollupAggregations   map[string]string
+	EmitSelfMetrics      bool
+	EmitMetaMetrics      bool
+	ExposeSampleCounts   bool
+	EmitChangedOnly      bool
+	EmitDatapointTime    bool
+	FillMissing          string
+	TaskCountSource      string
+	Source               string
+	ChangedEpsilon       float64
+	SanityCheck          bool
+	SanityBounds         map[string]Bounds
+	StartedAt            time.Time
+	Debug                bool
+
+	EmitUtilizationBands      bool
+	UtilizationBandBoundaries []float64
+	EnableContainerLevel      bool
+	ContainerInsights         bool
+	GPU                       bool
+	NoStacking                bool
+	TrimmedMeanPercent        float64
+	EmitClusterTotals         bool
+	IncludeClusterReservation bool
+	EmitCapacityProviders     bool
+	EmitAutoscaling           bool
+	WithContainerInstances    bool
+	EmitTaskEvents            bool
+	AllServices               bool
+	SharedCredentialsFile     string
+	FilterTags                map[string]string
+	ExcludeTags               map[string]string
+
+	ctx          context.Context
+	credentials  *credentials.Credentials
+	endpointMap  map[string]string
+	metricStream []metricStreamRecord
+	targetGroup  *targetGroup
+	services     []string
+	// the unix times of the datapoints of the stat keys, with EmitDatapointTime
+	times              map[string]float64
+	fallbackRegionUsed bool
 }
 
 // MetricKeyPrefix interface for PluginWithPrefix
@@ -46,191 +216,1633 @@ func (p ECSPlugin) MetricKeyPrefix() string {
 	return p.Prefix
 }
 
+func (p ECSPlugin) context() context.Context {
+	if p.ctx == nil {
+		return context.Background()
+	}
+	return p.ctx
+}
+
+func (p ECSPlugin) debugf(format string, v ...interface{}) {
+	if p.Debug {
+		log.Printf("debug: "+format, v...)
+	}
+}
+
 func (p *ECSPlugin) prepare() error {
-	sess, err := session.NewSession()
+	if p.Period == 0 {
+		p.Period = defaultPeriod
+	}
+	if p.Lookback == 0 {
+		p.Lookback = defaultLookback
+	}
+	if p.Timeout == 0 {
+		p.Timeout = defaultTimeout
+	}
+	if p.Period < 0 {
+		return fmt.Errorf("period must be positive: %s", p.Period)
+	}
+	if p.Lookback < p.Period {
+		return fmt.Errorf("lookback (%s) must be at least period (%s)", p.Lookback, p.Period)
+	}
+	if p.Source == sourceMetadata {
+		// the Task Metadata Endpoint requires neither a session nor credentials
+		return p.prepareTaskMetadata()
+	}
+	// the records of a metric stream file are not kept by CloudWatch
+	if p.MetricStreamFile == "" {
+		if err := checkRetention(p.Period, p.Lookback); err != nil {
+			return err
+		}
+	}
+
+	// static credentials set below take precedence over the ones of the profile
+	sess, err := session.NewSessionWithOptions(session.Options{
+		Config:            aws.Config{HTTPClient: p.httpClient()},
+		Profile:           p.Profile,
+		SharedConfigState: p.sharedConfigState(),
+		SharedConfigFiles: p.sharedConfigFiles(),
+	})
 	if err != nil {
 		return err
 	}
 
-	config := aws.NewConfig()
+	// the region of the profile (or of $AWS_REGION with the shared config loaded) comes next
+	if p.Region == "" && aws.StringValue(sess.Config.Region) != "" {
+		p.Region = aws.StringValue(sess.Config.Region)
+		p.debugf("region taken from the shared config: %s", p.Region)
+	}
+	if p.Region == "" {
+		p.Region, err = metadataRegion(sess)
+		if err != nil {
+			return fmt.Errorf("region is neither given nor configured for the profile, and cannot be detected from the EC2 instance metadata: %s", err)
+		}
+		p.debugf("region detected from the EC2 instance metadata: %s", p.Region)
+	}
+	if !regionReg.MatchString(p.Region) {
+		return fmt.Errorf("invalid region: %q (expected e.g. ap-northeast-1)", p.Region)
+	}
+
+	if p.Endpoint != "" && !validEndpointURL(p.Endpoint) {
+		return fmt.Errorf("invalid endpoint URL: %q", p.Endpoint)
+	}
+	if p.ECSEndpoint != "" && !validEndpointURL(p.ECSEndpoint) {
+		return fmt.Errorf("invalid ECS endpoint URL: %q", p.ECSEndpoint)
+	}
+	if p.EndpointMapFile != "" {
+		p.endpointMap, err = loadEndpointMap(p.EndpointMapFile)
+		if err != nil {
+			return err
+		}
+	}
+
 	if p.AccessKeyID != "" && p.SecretAccessKey != "" {
-		config = config.WithCredentials(credentials.NewStaticCredentials(p.AccessKeyID, p.SecretAccessKey, ""))
+		p.credentials = credentials.NewStaticCredentials(p.AccessKeyID, p.SecretAccessKey, "")
+	}
+	if p.AssumeRoleARN != "" {
+		if err := p.assumeRole(sess); err != nil {
+			return err
+		}
+	}
+
+	p.newClients(sess, p.Region)
+	if p.Debug {
+		p.logCredentialsProvider(sess)
+	}
+
+	if p.MetricStreamFile != "" {
+		p.metricStream, err = loadMetricStream(p.MetricStreamFile)
+		if err != nil {
+			return fmt.Errorf("failed to load the metric stream file: %s", err)
+		}
+	} else if p.FallbackRegion != "" {
+		// the services and the target group are looked up in the region which serves the data
+		p.probeFallbackRegion(sess)
+	}
+
+	if p.AllServices {
+		p.services, err = p.listServiceNames()
+		if err != nil {
+			return fmt.Errorf("failed to list services: %s", err)
+		}
+		p.debugf("services: %v", p.services)
+	}
+
+	if p.TargetGroupARN != "" {
+		p.targetGroup, err = p.resolveTargetGroup()
+		if err != nil {
+			return err
+		}
 	}
-	config = config.WithRegion(p.Region)
 
-	p.CloudWatch = cloudwatch.New(sess, config)
+	return nil
+}
 
+// assumeRole replaces the credentials with the ones of the role,
+// using the static or the session credentials as the base credentials.
+// It assumes the role once here so that an unassumable role fails early.
+func (p *ECSPlugin) assumeRole(sess *session.Session) error {
+	config := aws.NewConfig().WithRegion(p.Region)
+	if p.credentials != nil {
+		config = config.WithCredentials(p.credentials)
+	}
+	creds := stscreds.NewCredentials(sess.Copy(config), p.AssumeRoleARN, func(provider *stscreds.AssumeRoleProvider) {
+		if p.ExternalID != "" {
+			provider.ExternalID = aws.String(p.ExternalID)
+		}
+	})
+	if _, err := creds.GetWithContext(p.context()); err != nil {
+		return fmt.Errorf("failed to assume role %s: %s", p.AssumeRoleARN, err)
+	}
+	p.credentials = creds
 	return nil
 }
 
-func (p ECSPlugin) getLastPoint(metric metrics) (float64, error) {
-	now := time.Now()
+// httpClient returns the client of all AWS API requests.
+// It goes through the proxy of HTTP_PROXY/HTTPS_PROXY/NO_PROXY, and gives up a request stalled for Timeout.
+func (p ECSPlugin) httpClient() *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = http.ProxyFromEnvironment
+	return &http.Client{
+		Transport: transport,
+		Timeout:   p.Timeout,
+	}
+}
+
+// sharedConfigState loads the shared config (~/.aws/config) when a profile is given,
+// as the profile may be defined only there.
+func (p ECSPlugin) sharedConfigState() session.SharedConfigState {
+	if p.Profile != "" {
+		return session.SharedConfigEnable
+	}
+	return session.SharedConfigStateFromEnv
+}
+
+// sharedConfigFiles returns the file of SharedCredentialsFile, which may have the profiles
+// of both the credentials file and the config file, or nil for the files of the SDK:
+// ~/.aws/credentials, or %USERPROFILE%\.aws\credentials on Windows, and AWS_SHARED_CREDENTIALS_FILE.
+func (p ECSPlugin) sharedConfigFiles() []string {
+	if p.SharedCredentialsFile == "" {
+		return nil
+	}
+	return []string{p.SharedCredentialsFile}
+}
+
+// regionReg matches the region names, e.g. ap-northeast-1 and us-gov-west-1
+var regionReg = regexp.MustCompile(`^[a-z]{2}(-[a-z]+)+-[0-9]+$`)
+
+// metadataRegion returns the region of the EC2 instance the plugin runs on
+func metadataRegion(sess *session.Session) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), metadataTimeout)
+	defer cancel()
+	client := ec2metadata.New(sess, aws.NewConfig().WithMaxRetries(0))
+	return client.RegionWithContext(ctx)
+}
+
+func (p *ECSPlugin) newClients(sess *session.Session, region string) {
+	config := aws.NewConfig()
+	if p.credentials != nil {
+		config = config.WithCredentials(p.credentials)
+	}
+	// the default retryer backs off on throttling and 5xx errors and fails fast on the others.
+	// The backoff of throttled requests starts at RetryThrottleDelay, and any backoff is capped at RetryMaxDelay.
+	config = request.WithRetryer(config.WithRegion(region), client.DefaultRetryer{
+		NumMaxRetries:    p.MaxRetries,
+		MinThrottleDelay: p.RetryThrottleDelay,
+		MaxThrottleDelay: p.RetryMaxDelay,
+		MaxRetryDelay:    p.RetryMaxDelay,
+	})
+	if p.endpointMap != nil {
+		config = config.WithEndpointResolver(newEndpointResolver(p.endpointMap))
+	}
+
+	cloudWatchConfig := config.Copy()
+	// Endpoint takes precedence over the endpoint map
+	if p.Endpoint != "" {
+		cloudWatchConfig = cloudWatchConfig.WithEndpoint(p.Endpoint)
+	}
+	ecsConfig := config.Copy()
+	if p.ECSEndpoint != "" {
+		ecsConfig = ecsConfig.WithEndpoint(p.ECSEndpoint)
+	}
+	p.CloudWatch = cloudwatch.New(sess, cloudWatchConfig)
+	p.ECS = ecs.New(sess, ecsConfig)
+	p.ELBV2 = elbv2.New(sess, config)
+	p.AutoScaling = applicationautoscaling.New(sess, config)
+	p.STS = sts.New(sess, config)
+}
+
+// logCredentialsProvider logs which provider actually satisfied the credentials.
+func (p ECSPlugin) logCredentialsProvider(sess *session.Session) {
+	creds := p.credentials
+	if creds == nil {
+		creds = sess.Config.Credentials
+	}
+	v, err := creds.Get()
+	if err != nil {
+		p.debugf("failed to retrieve credentials: %s", err)
+		return
+	}
+	p.debugf("credentials provider: %s", v.ProviderName)
+}
+
+// probeFallbackRegion switches to the fallback region
+// when the primary region returns no CPUUtilization datapoints for the cluster.
+func (p *ECSPlugin) probeFallbackRegion(sess *session.Session) {
+	probe := metrics{"CPUUtilization", metricsTypeAverage}
+	// the CPUUtilization of the (first) cluster
+	sp := *p
+	sp.ClusterName = p.clusterNames()[0]
+	q := sp.namespaceQuery(probe, scopeCluster)
+	var err error
+	b := &batch{}
+	b.add(q, func(_ series, e error) {
+		err = e
+	})
+	p.fetch(b)
+	if err == nil {
+		return
+	}
+	log.Printf("%s: no data in region %q (%s), trying fallback region %q", probe, p.Region, err, p.FallbackRegion)
+	p.newClients(sess, p.FallbackRegion)
+	p.fallbackRegionUsed = true
+}
 
+func (p ECSPlugin) dimensions() []*cloudwatch.Dimension {
+	return p.scopedDimensions(scopeService)
+}
+
+func (p ECSPlugin) scopedDimensions(scope dimensionScope) []*cloudwatch.Dimension {
 	dimensions := []*cloudwatch.Dimension{
 		{
 			Name:  aws.String("ClusterName"),
 			Value: aws.String(p.ClusterName),
 		},
 	}
-	if p.ServiceName != "" {
+	if scope == scopeService && p.ServiceName != "" {
 		dimensions = append(dimensions, &cloudwatch.Dimension{
 			Name:  aws.String("ServiceName"),
 			Value: aws.String(p.ServiceName),
 		})
 	}
+	if scope == scopeService && p.TaskDefinitionFamily != "" {
+		dimensions = append(dimensions, &cloudwatch.Dimension{
+			Name:  aws.String("TaskDefinitionFamily"),
+			Value: aws.String(p.TaskDefinitionFamily),
+		})
+	}
+	return dimensions
+}
 
-	response, err := p.CloudWatch.GetMetricStatistics(&cloudwatch.GetMetricStatisticsInput{
-		Dimensions: dimensions,
-		StartTime:  aws.Time(now.Add(time.Duration(180) * time.Second * -1)), // 3 min (to fetch at least 1 data-point)
-		EndTime:    aws.Time(now),
-		MetricName: aws.String(metric.Name),
-		Period:     aws.Int64(60),
-		Statistics: []*string{aws.String(metric.Type)},
-		Namespace:  aws.String(namespace),
-	})
-	if err != nil {
-		return 0, err
+// query returns the query of the metric routed by metricRoutes
+func (p ECSPlugin) query(metric metrics) query {
+	route := metricRoutes[metric.Name]
+	if route.namespace == "" {
+		return p.namespaceQuery(metric, route.scope)
+	}
+	return query{
+		namespace:  route.namespace,
+		dimensions: p.scopedDimensions(route.scope),
+		metric:     metric,
+	}
+}
+
+// namespaceQuery returns the query of the metric of -namespace (AWS/ECS by default),
+// whose dimensions include ExtraDimensions
+func (p ECSPlugin) namespaceQuery(metric metrics, scope dimensionScope) query {
+	ns := p.Namespace
+	if ns == "" {
+		ns = namespace
+	}
+	return query{
+		namespace:  ns,
+		dimensions: append(p.scopedDimensions(scope), p.ExtraDimensions...),
+		metric:     metric,
 	}
+}
 
-	datapoints := response.Datapoints
-	if len(datapoints) == 0 {
-		return 0, errors.New("fetched no datapoints")
+// lastPoint returns the value to report from the series
+func (p ECSPlugin) lastPoint(s series, metric metrics) float64 {
+	if metric.Type == metricsTypeAverage && p.TrimmedMeanPercent > 0 {
+		return trimmedMean(s.values, p.TrimmedMeanPercent)
 	}
+	return p.selectPoint(s)
+}
+
+// selectPoint returns the value of the datapoint to report
+func (p ECSPlugin) selectPoint(s series) float64 {
+	return s.values[p.selectIndex(s)]
+}
+
+// setPoint stores the datapoint to report of the series as key
+func (p ECSPlugin) setPoint(stat map[string]float64, key string, s series) {
+	stat[key] = p.selectPoint(s)
+	p.recordTime(key, s)
+}
+
+// recordTime records the time of the datapoint reported as key with EmitDatapointTime
+func (p ECSPlugin) recordTime(key string, s series) {
+	if p.times != nil {
+		p.times[key] = float64(s.timestamps[p.selectIndex(s)].Unix())
+	}
+}
 
-	// get a least recently datapoint
-	// because a most recently datapoint is not stable.
-	least := time.Now()
-	var latestVal float64
-	for _, dp := range datapoints {
-		if dp.Timestamp.Before(least) {
-			least = *dp.Timestamp
-			switch metric.Type {
-			case metricsTypeAverage:
-				latestVal = *dp.Average
-			case metricsTypeMinimum:
-				latestVal = *dp.Minimum
-			case metricsTypeMaximum:
-				latestVal = *dp.Maximum
-			case metricsTypeSampleCount:
-				latestVal = *dp.SampleCount
+// selectIndex returns the index of the datapoint to report. It is the least recent one,
+// or the most recent one older than DatapointLag when DatapointLag is set.
+func (p ECSPlugin) selectIndex(s series) int {
+	if p.DatapointLag > 0 {
+		return s.newestUntil(time.Now().Add(-p.DatapointLag))
+	}
+	return s.leastRecent()
+}
+
+// trimmedMean discards the top and bottom percent of the values before averaging them.
+// It is the plain mean when there are too few values to trim.
+func trimmedMean(values []float64, percent float64) float64 {
+	sorted := append([]float64(nil), values...)
+	sort.Float64s(sorted)
+	if k := int(float64(len(sorted)) * percent / 100); k > 0 && len(sorted)-2*k > 0 {
+		sorted = sorted[k : len(sorted)-k]
+	}
+	var sum float64
+	for _, v := range sorted {
+		sum += v
+	}
+	return sum / float64(len(sorted))
+}
+
+// addUtilizationBands reports the percentage of CPUUtilization datapoints
+// in the window falling in each band, e.g. [0, 25), [25, 50), [50, 75), [75, ).
+func (p ECSPlugin) addUtilizationBands(b *batch, stat map[string]float64) {
+	met := metrics{"CPUUtilization", metricsTypeAverage}
+	b.add(p.query(met), func(s series, err error) {
+		if err != nil {
+			p.logQueryError(fmt.Sprint(met), err)
+			return
+		}
+		if s.Len() < 2 {
+			log.Printf("%s: %d datapoint(s) are too few to compute utilization bands", met, s.Len())
+			return
+		}
+
+		bands := p.utilizationBands()
+		counts := make([]int, len(bands))
+		for _, v := range s.values {
+			for i := len(bands) - 1; i >= 0; i-- {
+				if v >= bands[i].lower {
+					counts[i]++
+					break
+				}
 			}
 		}
+		for i, band := range bands {
+			stat[band.name] = float64(counts[i]) * 100 / float64(s.Len())
+		}
+	})
+}
+
+// addSampleCountSum reports the SampleCount of CPUUtilization summed over the window.
+// A dip indicates missing datapoints.
+func (p ECSPlugin) addSampleCountSum(b *batch, stat map[string]float64) {
+	met := metrics{"CPUUtilization", metricsTypeSampleCount}
+	b.add(p.query(met), func(s series, err error) {
+		if err != nil {
+			p.logQueryError(fmt.Sprint(met), err)
+			return
+		}
+		var sum float64
+		for _, v := range s.values {
+			sum += v
+		}
+		stat["sampleCountSum"] = sum
+	})
+}
+
+// addTaskRunning reports the running tasks of the service from the SampleCount of its
+// CPUUtilization, which every running task reports once a minute. It is averaged over
+// the window so that a datapoint still being ingested doesn't undercount the tasks.
+func (p ECSPlugin) addTaskRunning(b *batch, stat map[string]float64) {
+	met := metrics{"CPUUtilization", metricsTypeSampleCount}
+	b.add(p.query(met), func(s series, err error) {
+		if err != nil {
+			p.logQueryError(fmt.Sprint(met), err)
+			p.markMissing(stat, "TaskRunning", err)
+			return
+		}
+		var sum float64
+		for _, v := range s.values {
+			sum += v
+		}
+		perMinute := p.Period.Minutes()
+		if perMinute < 1 {
+			perMinute = 1
+		}
+		stat["TaskRunning"] = math.Round(sum / float64(s.Len()) / perMinute)
+	})
+}
+
+type utilizationBand struct {
+	name  string
+	label string
+	lower float64
+}
+
+func (p ECSPlugin) utilizationBands() []utilizationBand {
+	lowers := append([]float64{0}, p.UtilizationBandBoundaries...)
+	bands := make([]utilizationBand, len(lowers))
+	for i, lower := range lowers {
+		from := strconv.FormatFloat(lower, 'f', -1, 64)
+		to := ""
+		if i+1 < len(lowers) {
+			to = strconv.FormatFloat(lowers[i+1], 'f', -1, 64)
+		}
+		bands[i] = utilizationBand{
+			name:  "CPUUtilizationBand" + strings.Replace(from, ".", "_", -1) + "To" + strings.Replace(to, ".", "_", -1),
+			label: from + "-" + to,
+			lower: lower,
+		}
+	}
+	return bands
+}
+
+// defaultUtilizationBands are the band boundaries of -utilization-bands by default
+var defaultUtilizationBands = []float64{25, 50, 75}
+
+// parseUtilizationBands parses comma separated band boundaries such as "25,50,75"
+func parseUtilizationBands(s string) ([]float64, error) {
+	var boundaries []float64
+	for _, f := range strings.Split(s, ",") {
+		v, err := strconv.ParseFloat(strings.TrimSpace(f), 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid utilization band boundary %q: %s", f, err)
+		}
+		if v <= 0 || (len(boundaries) > 0 && v <= boundaries[len(boundaries)-1]) {
+			return nil, fmt.Errorf("utilization band boundaries must be positive and increasing: %q", s)
+		}
+		boundaries = append(boundaries, v)
 	}
+	return boundaries, nil
+}
 
-	return latestVal, nil
+// addLastPoint stores the last point of the metric as key
+func (p ECSPlugin) addLastPoint(b *batch, stat map[string]float64, key string, met metrics) {
+	b.add(p.query(met), func(s series, err error) {
+		if err != nil {
+			p.logQueryError(fmt.Sprint(met), err)
+			p.markMissing(stat, key, err)
+			return
+		}
+		stat[key] = p.lastPoint(s, met)
+		p.recordTime(key, s)
+	})
 }
 
 // FetchMetrics fetch the metrics
 func (p ECSPlugin) FetchMetrics() (map[string]float64, error) {
+	if p.FetchDeadline > 0 {
+		// p is a copy, so the deadline applies to this fetch only
+		var cancel context.CancelFunc
+		p.ctx, cancel = context.WithTimeout(p.context(), p.FetchDeadline)
+		defer cancel()
+	}
+	if p.Source == sourceMetadata {
+		return p.fetchTaskMetadataMetrics()
+	}
+	ctx := p.context()
+	names, targets := p.targets()
+
+	// all CloudWatch metrics of all clusters and services are fetched together by GetMetricData
+	stats := make([]map[string]float64, len(targets))
+	batches := make([]*batch, len(targets))
+	for i := range targets {
+		stats[i] = make(map[string]float64)
+		if p.times != nil && p.nested() {
+			targets[i].times = make(map[string]float64)
+		}
+		batches[i] = &batch{}
+		targets[i].addServiceQueries(batches[i], stats[i])
+	}
+	b := interleave(batches)
+	// the metrics of the cluster are reported once, outside of the stats of the services
+	clusterStat := make(map[string]float64)
+	if p.includesClusterReservation() {
+		p.addGraphQueries(b, clusterStat, p.reservationGraphDefinition())
+	}
+	if p.EmitCapacityProviders && ctx.Err() == nil {
+		p.addCapacityProviders(b, clusterStat)
+	}
+	if p.WithContainerInstances && ctx.Err() == nil {
+		p.fetchContainerInstances(clusterStat)
+	}
+	if ctx.Err() == nil {
+		p.fetch(b)
+		// the queries of a request share its latency, so only the requests are measured
+		if p.EmitMetaMetrics && len(b.queries) > 0 {
+			clusterStat["getMetricDataLatency"] = float64(b.latency) / float64(time.Millisecond)
+		}
+	}
+
+	serviceStats := make(map[string]map[string]float64)
+	for i, t := range targets {
+		if t.ServiceName != "" {
+			serviceStats[t.ServiceName] = stats[i]
+		}
+	}
+	// the services are described once for both their task counts and their events
+	var services []*ecs.Service
+	if len(serviceStats) > 0 && (p.TaskCountSource != taskCountCloudWatch || p.EmitTaskEvents) && ctx.Err() == nil {
+		serviceNames := make([]string, 0, len(serviceStats))
+		for name := range serviceStats {
+			serviceNames = append(serviceNames, name)
+		}
+		sort.Strings(serviceNames)
+		services = p.describeServices(serviceNames)
+	}
+	if len(serviceStats) > 0 && p.TaskCountSource != taskCountCloudWatch && ctx.Err() == nil {
+		p.fetchServiceTasks(serviceStats, services)
+	}
+	if p.EmitTaskEvents && len(serviceStats) > 0 && ctx.Err() == nil {
+		p.fetchTaskEvents(serviceStats, services)
+	}
+	if p.EmitAutoscaling && len(serviceStats) > 0 && ctx.Err() == nil {
+		p.fetchScalableTargets(serviceStats)
+	}
+
+	// with all-services, the cluster may have no services (or none matching the tags) to target
+	var stat map[string]float64
+	if !p.nested() {
+		stat = stats[0]
+	} else {
+		stat = make(map[string]float64)
+		for i, t := range targets {
+			for key, v := range t.qualifiedStat(stats[i]) {
+				stat[names[i]+"."+key] = v
+			}
+			for key, v := range t.qualifiedStat(t.times) {
+				p.times[names[i]+"."+key] = v
+			}
+		}
+	}
+
+	if p.multiService() {
+		p.addServiceAggregates(stat, names, stats)
+		if p.EmitServiceRollup {
+			p.addServiceRollup(stat, stats)
+		}
+	}
+	for key, v := range clusterStat {
+		stat[key] = v
+	}
+	if p.FillMissing == fillZero || p.FillMissing == fillLast {
+		p.fillMissing(stat)
+	}
+	if p.ZeroGrace > 0 {
+		p.debounceZero(stat)
+	}
+	if p.EmitClusterTotals && ctx.Err() == nil {
+		p.fetchClusterTotals(stat)
+	}
+	if ctx.Err() != nil {
+		log.Printf("collection interrupted (%s), emitting partial results", ctx.Err())
+	}
+	if p.FallbackRegion != "" {
+		stat["fallbackRegionUsed"] = 0
+		if p.fallbackRegionUsed {
+			stat["fallbackRegionUsed"] = 1
+		}
+	}
+	if p.EmitSelfMetrics {
+		p.fetchSelfMetrics(stat)
+	}
+	if p.SanityCheck {
+		p.dropInsaneValues(stat)
+	}
+	if p.EmitChangedOnly {
+		p.dropUnchanged(stat)
+	}
+
+	return stat, nil
+}
+
+// fetchTaskMetadataMetrics is FetchMetrics of -source metadata
+func (p ECSPlugin) fetchTaskMetadataMetrics() (map[string]float64, error) {
 	stat := make(map[string]float64)
+	if err := p.fetchTaskMetadata(stat); err != nil {
+		return nil, err
+	}
+	if p.EmitSelfMetrics {
+		p.fetchSelfMetrics(stat)
+	}
+	if p.SanityCheck {
+		p.dropInsaneValues(stat)
+	}
+	if p.EmitChangedOnly {
+		p.dropUnchanged(stat)
+	}
+	return stat, nil
+}
 
-	for name := range p.GraphDefinition() {
-		if name == "Task" {
-			met := metrics{"CPUUtilization", metricsTypeSampleCount}
-			v, err := p.getLastPoint(met)
-			if err == nil {
-				stat[name+"Running"] = v
-			} else {
-				log.Printf("%s: %s", met, err)
+// addServiceQueries adds the queries of the metrics of serviceGraphDefinition to the batch
+func (p ECSPlugin) addServiceQueries(b *batch, stat map[string]float64) {
+	p.addGraphQueries(b, stat, p.cloudWatchGraphDefinition())
+	if p.EmitUtilizationBands {
+		p.addUtilizationBands(b, stat)
+	}
+	if p.EnableContainerLevel {
+		p.addContainerMetrics(b, stat)
+	}
+	if p.TargetGroupARN != "" {
+		p.addTargetHealth(b, stat)
+	}
+	if p.ExposeSampleCounts {
+		p.addSampleCountSum(b, stat)
+	}
+	if p.ServiceName != "" && p.TaskCountSource == taskCountCloudWatch {
+		p.addTaskRunning(b, stat)
+	}
+}
+
+// addGraphQueries adds the queries of the metrics of the graphs, which are keyed by
+// the CloudWatch metric, to the batch
+func (p ECSPlugin) addGraphQueries(b *batch, stat map[string]float64, graphs map[string]mp.Graphs) {
+	// the graph metrics are named after the CloudWatch metric and the statistic
+	for name, g := range graphs {
+		for _, m := range g.Metrics {
+			p.addLastPoint(b, stat, m.Name, metrics{name, statisticOf(strings.TrimPrefix(m.Name, name))})
+		}
+	}
+}
+
+// qualifiedStat maps stat into the values keyed by "<graph>.<metric>", which are
+// the stat keys of the per-service graphs of the multi-service GraphDefinition.
+func (p ECSPlugin) qualifiedStat(stat map[string]float64) map[string]float64 {
+	values := make(map[string]float64)
+	for key, graph := range p.serviceGraphDefinition() {
+		for _, metric := range graph.Metrics {
+			wildcard := strings.ContainsAny(key+metric.Name, "*#")
+			for _, k := range graphStatKeys(key, metric, stat) {
+				// the keys of wildcard metrics already include the graph key
+				if wildcard {
+					values[k] = stat[k]
+				} else {
+					values[key+"."+k] = stat[k]
+				}
 			}
-			continue
 		}
+	}
+	return values
+}
+
+// targets returns the clusters or services whose graphs are nested under their names,
+// sanitized into metric key segments, with multiple clusters or services, or else p itself
+// with an empty name.
+func (p ECSPlugin) targets() ([]string, []ECSPlugin) {
+	var names []string
+	var targets []ECSPlugin
+	switch {
+	case p.multiCluster():
+		for _, name := range p.clusterNames() {
+			sp := p
+			sp.ClusterName = name
+			names, targets = append(names, sanitizeMetricKey(name)), append(targets, sp)
+		}
+	case p.multiService():
+		for _, name := range p.serviceNames() {
+			sp := p
+			sp.ServiceName, sp.AllServices = name, false
+			names, targets = append(names, sanitizeMetricKey(name)), append(targets, sp)
+		}
+	default:
+		names, targets = []string{""}, []ECSPlugin{p}
+	}
+	return names, targets
+}
+
+// nested reports whether the graphs of each cluster or service are emitted under its name
+func (p ECSPlugin) nested() bool {
+	return p.multiCluster() || p.multiService()
+}
+
+// multiCluster reports whether the graphs of each cluster are emitted under the cluster name
+func (p ECSPlugin) multiCluster() bool {
+	return len(p.clusterNames()) > 1
+}
+
+// clusterNames returns the comma separated names of ClusterName
+func (p ECSPlugin) clusterNames() []string {
+	return splitNames(p.ClusterName)
+}
+
+// multiService reports whether the graphs of each service are emitted under the service name
+func (p ECSPlugin) multiService() bool {
+	return p.AllServices || len(p.serviceNames()) > 1
+}
+
+// serviceNames returns the services of the cluster with AllServices,
+// or else the comma separated names of ServiceName
+func (p ECSPlugin) serviceNames() []string {
+	if p.AllServices {
+		return p.services
+	}
+	return splitNames(p.ServiceName)
+}
+
+func splitNames(s string) []string {
+	var names []string
+	for _, name := range strings.Split(s, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			names = append(names, name)
+		}
+	}
+	return names
+}
 
-		for _, t := range []string{metricsTypeAverage, metricsTypeMinimum, metricsTypeMaximum} {
-			met := metrics{name, t}
-			v, err := p.getLastPoint(met)
-			if err == nil {
-				stat[name+t] = v
-			} else {
-				log.Printf("%s: %s", met, err)
+// markMissing marks the metric of a query without datapoints with NaN to be filled by fillMissing
+func (p ECSPlugin) markMissing(stat map[string]float64, key string, err error) {
+	if (p.FillMissing == fillZero || p.FillMissing == fillLast) && errors.Is(err, errNoDatapoints) {
+		stat[key] = math.NaN()
+	}
+}
+
+// fillMissing reports the metrics marked by markMissing as 0, or as the value reported
+// last time with fillLast. A metric never reported before is dropped with fillLast.
+func (p ECSPlugin) fillMissing(stat map[string]float64) {
+	if p.FillMissing == fillZero {
+		for key, v := range stat {
+			if math.IsNaN(v) {
+				stat[key] = 0
 			}
 		}
+		return
 	}
 
-	return stat, nil
+	path := p.stateFile("reported")
+	reported := make(map[string]float64)
+	if err := loadState(path, &reported); err != nil {
+		log.Printf("failed to load last reported values (ignore): %s", err)
+	}
+	for key, v := range stat {
+		if !math.IsNaN(v) {
+			reported[key] = v
+			continue
+		}
+		if last, ok := reported[key]; ok {
+			stat[key] = last
+		} else {
+			delete(stat, key)
+		}
+	}
+	if err := saveState(path, reported); err != nil {
+		log.Printf("failed to save reported values: %s", err)
+	}
+}
+
+// dropUnchanged removes the metrics whose value is within ChangedEpsilon
+// of the value emitted last time.
+func (p ECSPlugin) dropUnchanged(stat map[string]float64) {
+	path := p.stateFile("emitted")
+	emitted := make(map[string]float64)
+	if err := loadState(path, &emitted); err != nil {
+		log.Printf("failed to load last emitted values (ignore): %s", err)
+	}
+	for key, v := range stat {
+		if last, ok := emitted[key]; ok && math.Abs(v-last) <= p.ChangedEpsilon {
+			delete(stat, key)
+			continue
+		}
+		emitted[key] = v
+	}
+	if err := saveState(path, emitted); err != nil {
+		log.Printf("failed to save emitted values: %s", err)
+	}
+}
+
+// fetchSelfMetrics reports the plugin's own resource usage: the memory the Go runtime
+// has obtained from the OS (MemStats.Sys), and the time since the plugin started.
+func (p ECSPlugin) fetchSelfMetrics(stat map[string]float64) {
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	stat["memorySys"] = float64(m.Sys)
+	if !p.StartedAt.IsZero() {
+		stat["runtimeSeconds"] = time.Since(p.StartedAt).Seconds()
+	}
+}
+
+// labelPrefix title-cases the words of the prefix split on "-" and "_", e.g. "ecs_prod-web"
+// into "Ecs Prod Web". Capital letters are kept, so "ECS" stays "ECS".
+func (p ECSPlugin) labelPrefix() string {
+	caser := cases.Title(language.Und, cases.NoLower)
+	words := strings.FieldsFunc(p.Prefix, func(r rune) bool {
+		return r == '-' || r == '_'
+	})
+	for i, w := range words {
+		words[i] = caser.String(w)
+	}
+	return strings.Join(words, " ")
 }
 
 // GraphDefinition of ECSPlugin
 func (p ECSPlugin) GraphDefinition() map[string]mp.Graphs {
-	labelPrefix := strings.Title(p.Prefix)
-	labelPrefix = strings.Replace(labelPrefix, "-", " ", -1)
+	graphs := p.serviceGraphDefinition()
+	if p.Source == sourceMetadata {
+		graphs = p.taskMetadataGraphDefinition()
+	} else if p.nested() {
+		// the graphs of each cluster or service are emitted under "<cluster>." or "<service>."
+		sp := p
+		if p.multiService() {
+			sp.ServiceName = "#"
+		}
+		graphs = make(map[string]mp.Graphs)
+		for key, g := range sp.serviceGraphDefinition() {
+			graphs[targetWildcard+key] = g
+		}
+	}
 
-	baseGraphs := map[string]mp.Graphs{
-		"CPUUtilization": {
-			Label: labelPrefix + " CPUUtilization",
-			Unit:  "percentage",
+	if p.multiService() {
+		for key, g := range p.serviceAggregateGraphDefinition() {
+			graphs[key] = g
+		}
+	}
+
+	labelPrefix := p.labelPrefix()
+	if p.EmitClusterTotals {
+		graphs["ClusterTask"] = mp.Graphs{
+			Label: labelPrefix + " Cluster Task",
+			Unit:  "integer",
 			Metrics: []mp.Metrics{
-				{Name: "CPUUtilizationAverage", Label: "Average"},
-				{Name: "CPUUtilizationMinimum", Label: "Minimum"},
-				{Name: "CPUUtilizationMaximum", Label: "Maximum"},
+				{Name: "ClusterTaskRunning", Label: "Running", Stacked: !p.NoStacking},
+				{Name: "ClusterTaskPending", Label: "Pending", Stacked: !p.NoStacking},
+				{Name: "ClusterTaskDesired", Label: "Desired"},
 			},
-		},
-		"MemoryUtilization": {
-			Label: labelPrefix + " MemoryUtilization",
-			Unit:  "percentage",
+		}
+	}
+	if p.includesClusterReservation() {
+		for key, g := range p.reservationGraphDefinition() {
+			graphs[key] = g
+		}
+	}
+	if p.EmitCapacityProviders {
+		for key, g := range p.capacityProviderGraphDefinition() {
+			graphs[key] = g
+		}
+	}
+	if p.WithContainerInstances {
+		for key, g := range p.containerInstanceGraphDefinition() {
+			graphs[key] = g
+		}
+	}
+	if p.FallbackRegion != "" {
+		graphs["meta.region"] = mp.Graphs{
+			Label: labelPrefix + " Serving Region",
+			Unit:  "integer",
 			Metrics: []mp.Metrics{
-				{Name: "MemoryUtilizationAverage", Label: "Average"},
-				{Name: "MemoryUtilizationMinimum", Label: "Minimum"},
-				{Name: "MemoryUtilizationMaximum", Label: "Maximum"},
+				{Name: "fallbackRegionUsed", Label: "Fallback Region Used"},
 			},
-		},
+		}
 	}
-	if p.ServiceName != "" {
-		baseGraphs["Task"] = mp.Graphs{
+	if p.EmitMetaMetrics && p.Source != sourceMetadata {
+		graphs["meta.latency"] = mp.Graphs{
+			Label: labelPrefix + " CloudWatch Request Latency",
+			Unit:  "milliseconds",
+			Metrics: []mp.Metrics{
+				{Name: "getMetricDataLatency", Label: "GetMetricData"},
+			},
+		}
+	}
+	if p.EmitSelfMetrics {
+		graphs["meta.memory"] = mp.Graphs{
+			Label: labelPrefix + " Plugin Memory",
+			Unit:  "bytes",
+			Metrics: []mp.Metrics{
+				{Name: "memorySys", Label: "Obtained from OS"},
+			},
+		}
+		graphs["meta.runtime"] = mp.Graphs{
+			Label: labelPrefix + " Plugin Runtime",
+			Unit:  "seconds",
+			Metrics: []mp.Metrics{
+				{Name: "runtimeSeconds", Label: "Seconds"},
+			},
+		}
+	}
+	return graphs
+}
+
+// serviceGraphDefinition returns the graphs of a service, or of the cluster without a service
+func (p ECSPlugin) serviceGraphDefinition() map[string]mp.Graphs {
+	graphs := p.cloudWatchGraphDefinition()
+	labelPrefix := p.labelPrefix()
+	if p.EmitUtilizationBands {
+		var bandMetrics []mp.Metrics
+		for _, b := range p.utilizationBands() {
+			bandMetrics = append(bandMetrics, mp.Metrics{Name: b.name, Label: b.label, Stacked: !p.NoStacking})
+		}
+		graphs["CPUUtilizationBands"] = mp.Graphs{
+			Label:   labelPrefix + " CPUUtilization Bands",
+			Unit:    "percentage",
+			Metrics: bandMetrics,
+		}
+	}
+	if p.EnableContainerLevel {
+		for key, g := range p.containerGraphDefinition() {
+			graphs[key] = g
+		}
+	}
+	if p.TargetGroupARN != "" {
+		graphs["TargetGroupHealth"] = mp.Graphs{
+			Label: labelPrefix + " Target Group Health",
+			Unit:  "integer",
+			Metrics: []mp.Metrics{
+				{Name: "TargetGroupHealthy", Label: "Healthy", Stacked: !p.NoStacking},
+				{Name: "TargetGroupUnhealthy", Label: "Unhealthy", Stacked: !p.NoStacking},
+			},
+		}
+	}
+	if p.ServiceName != "" && p.TaskCountSource == taskCountCloudWatch {
+		// without the ECS API, only the running tasks are known
+		graphs["Task"] = mp.Graphs{
 			Label: labelPrefix + " Task",
 			Unit:  "integer",
 			Metrics: []mp.Metrics{
 				{Name: "TaskRunning", Label: "Running"},
 			},
 		}
-		return baseGraphs
 	}
-	baseGraphs["CPUReservation"] = mp.Graphs{
-		Label: labelPrefix + " CPUReservation",
-		Unit:  "percentage",
-		Metrics: []mp.Metrics{
-			{Name: "CPUReservationAverage", Label: "Average"},
-			{Name: "CPUReservationMinimum", Label: "Minimum"},
-			{Name: "CPUReservationMaximum", Label: "Maximum"},
-		},
+	if p.ServiceName != "" && p.TaskCountSource != taskCountCloudWatch {
+		graphs["Task"] = mp.Graphs{
+			Label: labelPrefix + " Task",
+			Unit:  "integer",
+			Metrics: []mp.Metrics{
+				{Name: "TaskRunning", Label: "Running", Stacked: !p.NoStacking},
+				{Name: "TaskPending", Label: "Pending", Stacked: !p.NoStacking},
+				{Name: "TaskDesired", Label: "Desired"},
+			},
+		}
+		if p.EmitAutoscaling {
+			for key, g := range p.autoscalingGraphDefinition() {
+				graphs[key] = g
+			}
+		}
+		graphs["Deployment"] = mp.Graphs{
+			Label: labelPrefix + " Deployment",
+			Unit:  "integer",
+			Metrics: []mp.Metrics{
+				{Name: "DeploymentCount", Label: "Count"},
+				{Name: "DeploymentPrimary", Label: "Primary", Stacked: !p.NoStacking},
+				{Name: "DeploymentActive", Label: "Active", Stacked: !p.NoStacking},
+			},
+		}
+		graphs["Rollout"] = mp.Graphs{
+			Label: labelPrefix + " Rollout State",
+			Unit:  "integer",
+			Metrics: []mp.Metrics{
+				{Name: "RolloutInProgress", Label: "In Progress"},
+				{Name: "RolloutCompleted", Label: "Completed"},
+				{Name: "RolloutFailed", Label: "Failed"},
+			},
+		}
+		graphs["DeploymentFailedTasks"] = mp.Graphs{
+			Label: labelPrefix + " Deployment Failed Tasks",
+			Unit:  "integer",
+			Metrics: []mp.Metrics{
+				{Name: "DeploymentFailedTasks", Label: "Failed Tasks"},
+			},
+		}
+	}
+	if p.ServiceName != "" && p.EmitTaskEvents {
+		for key, g := range p.taskEventGraphDefinition() {
+			graphs[key] = g
+		}
+	}
+	if p.ExposeSampleCounts {
+		graphs["meta"] = mp.Graphs{
+			Label: labelPrefix + " CPUUtilization SampleCount",
+			Unit:  "integer",
+			Metrics: []mp.Metrics{
+				{Name: "sampleCountSum", Label: "Sum"},
+			},
+		}
 	}
-	baseGraphs["MemoryReservation"] = mp.Graphs{
-		Label: labelPrefix + " MemoryReservation",
-		Unit:  "percentage",
-		Metrics: []mp.Metrics{
-			{Name: "MemoryReservationAverage", Label: "Average"},
-			{Name: "MemoryReservationMinimum", Label: "Minimum"},
-			{Name: "MemoryReservationMaximum", Label: "Maximum"},
+	return graphs
+}
+
+// defaultStatistics are the statistics of the CloudWatch metrics emitted by default
+var defaultStatistics = []string{metricsTypeAverage, metricsTypeMinimum, metricsTypeMaximum}
+
+// statistics returns the statistics of the CloudWatch metrics to emit
+func (p ECSPlugin) statistics() []string {
+	if len(p.Statistics) == 0 {
+		return defaultStatistics
+	}
+	return p.Statistics
+}
+
+// statisticMetrics returns the graph metrics of the statistics of the CloudWatch metric,
+// named after the metric and the statistic such as "CPUUtilizationAverage".
+func (p ECSPlugin) statisticMetrics(name string, scale float64) []mp.Metrics {
+	var metrics []mp.Metrics
+	for _, t := range p.statistics() {
+		metrics = append(metrics, mp.Metrics{Name: name + t, Label: t, Scale: scale})
+	}
+	return metrics
+}
+
+func (p ECSPlugin) hasStatistic(t string) bool {
+	for _, s := range p.statistics() {
+		if s == t {
+			return true
+		}
+	}
+	return false
+}
+
+// stringsFlag is a repeatable flag, also given as comma separated values
+type stringsFlag []string
+
+func (f *stringsFlag) String() string {
+	return strings.Join(*f, ",")
+}
+
+func (f *stringsFlag) Set(v string) error {
+	for _, s := range strings.Split(v, ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			*f = append(*f, s)
+		}
+	}
+	return nil
+}
+
+// reset clears the values before -config sets the ones of a target
+func (f *stringsFlag) reset() {
+	*f = nil
+}
+
+// parseDimensions parses the Name=Value dimensions of -dimension
+func parseDimensions(list []string) ([]*cloudwatch.Dimension, error) {
+	var dimensions []*cloudwatch.Dimension
+	seen := make(map[string]bool)
+	for _, d := range list {
+		name, value, ok := strings.Cut(d, "=")
+		name = strings.TrimSpace(name)
+		if !ok || name == "" {
+			return nil, fmt.Errorf("invalid dimension %q: expected Name=Value", d)
+		}
+		switch name {
+		case "ClusterName", "ServiceName", "TaskDefinitionFamily":
+			return nil, fmt.Errorf("invalid dimension %q: %s is given by its own option", d, name)
+		}
+		if seen[name] {
+			return nil, fmt.Errorf("duplicate dimension %s", name)
+		}
+		seen[name] = true
+		dimensions = append(dimensions, &cloudwatch.Dimension{
+			Name:  aws.String(name),
+			Value: aws.String(value),
+		})
+	}
+	return dimensions, nil
+}
+
+// parseStatistics parses comma separated statistics such as "Average,Maximum"
+func parseStatistics(s string) ([]string, error) {
+	var statistics []string
+	for _, t := range strings.Split(s, ",") {
+		t = strings.TrimSpace(t)
+		switch t {
+		case metricsTypeAverage, metricsTypeMinimum, metricsTypeMaximum, metricsTypeSum, metricsTypeSampleCount:
+			statistics = append(statistics, t)
+		default:
+			return nil, fmt.Errorf("unknown statistic %q: expected Average, Minimum, Maximum, Sum or SampleCount", t)
+		}
+	}
+	return statistics, nil
+}
+
+// extendedStatisticReg matches the percentiles such as p90 and p99.9
+var extendedStatisticReg = regexp.MustCompile(`^p(100|[0-9]{1,2}(\.[0-9]{1,2})?)$`)
+
+// parseExtendedStatistics parses comma separated percentiles such as "p50,p90,p99"
+func parseExtendedStatistics(s string) ([]string, error) {
+	var statistics []string
+	for _, t := range strings.Split(s, ",") {
+		if t = strings.TrimSpace(t); t == "" {
+			continue
+		}
+		if !extendedStatisticReg.MatchString(t) {
+			return nil, fmt.Errorf("invalid extended statistic %q: expected a percentile such as p90 or p99.9", t)
+		}
+		statistics = append(statistics, t)
+	}
+	return statistics, nil
+}
+
+// statisticKey makes the statistic usable in a metric key, e.g. "p99.9" into "p99_9"
+func statisticKey(t string) string {
+	return strings.Replace(t, ".", "_", 1)
+}
+
+// statisticOf is the inverse of statisticKey
+func statisticOf(key string) string {
+	if extendedStatisticReg.MatchString(strings.Replace(key, "_", ".", 1)) {
+		return strings.Replace(key, "_", ".", 1)
+	}
+	return key
+}
+
+// cloudWatchGraphDefinition returns the graphs whose metrics are fetched from CloudWatch
+func (p ECSPlugin) cloudWatchGraphDefinition() map[string]mp.Graphs {
+	labelPrefix := p.labelPrefix()
+	// AWS/ECS has no metrics per task definition family
+	if p.TaskDefinitionFamily != "" {
+		graphs := p.containerInsightGraphs(taskFamilyInsights)
+		if p.ContainerInsights {
+			for key, g := range p.containerInsightsGraphDefinition() {
+				graphs[key] = g
+			}
+		}
+		return graphs
+	}
+
+	baseGraphs := map[string]mp.Graphs{
+		"CPUUtilization": {
+			Label:   labelPrefix + " CPUUtilization",
+			Unit:    "percentage",
+			Metrics: p.statisticMetrics("CPUUtilization", 0),
+		},
+		"MemoryUtilization": {
+			Label:   labelPrefix + " MemoryUtilization",
+			Unit:    "percentage",
+			Metrics: p.statisticMetrics("MemoryUtilization", 0),
 		},
 	}
+	if p.ContainerInsights || p.LaunchType == launchTypeFargate {
+		for key, g := range p.containerInsightsGraphDefinition() {
+			baseGraphs[key] = g
+		}
+	}
+	if p.ServiceName != "" {
+		return baseGraphs
+	}
+	for key, g := range p.reservationGraphDefinition() {
+		baseGraphs[key] = g
+	}
 	return baseGraphs
 }
 
+// reservationGraphDefinition returns the graphs of the reservations of the cluster,
+// which metricRoutes queries with the ClusterName dimension only.
+func (p ECSPlugin) reservationGraphDefinition() map[string]mp.Graphs {
+	graphs := make(map[string]mp.Graphs)
+	// Fargate-only clusters have no EC2 capacity to reserve against
+	if p.LaunchType == launchTypeFargate {
+		return graphs
+	}
+	labelPrefix := p.labelPrefix()
+	graphs["CPUReservation"] = mp.Graphs{
+		Label:   labelPrefix + " CPUReservation",
+		Unit:    "percentage",
+		Metrics: p.statisticMetrics("CPUReservation", 0),
+	}
+	graphs["MemoryReservation"] = mp.Graphs{
+		Label:   labelPrefix + " MemoryReservation",
+		Unit:    "percentage",
+		Metrics: p.statisticMetrics("MemoryReservation", 0),
+	}
+	// GPUReservation is published only for the clusters with GPU instances
+	if p.GPU {
+		graphs["GPUReservation"] = mp.Graphs{
+			Label:   labelPrefix + " GPUReservation",
+			Unit:    "percentage",
+			Metrics: p.statisticMetrics("GPUReservation", 0),
+		}
+	}
+	return graphs
+}
+
+// includesClusterReservation reports whether the reservation graphs of the cluster are emitted
+// once besides the graphs of the services or the task definition family
+func (p ECSPlugin) includesClusterReservation() bool {
+	return p.IncludeClusterReservation && (p.ServiceName != "" || p.AllServices || p.TaskDefinitionFamily != "")
+}
+
+// envFlags are the environment variables which fill in the flags not given on the command line.
+// AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY are left to the credential chain of the SDK,
+// which takes AWS_SESSION_TOKEN of temporary credentials along with them.
+var envFlags = map[string]string{
+	"region":            "AWS_REGION",
+	"cluster-name":      "ECS_CLUSTER_NAME",
+	"service-name":      "ECS_SERVICE_NAME",
+	"metric-key-prefix": "MACKEREL_ECS_PREFIX",
+	"endpoint":          "AWS_ENDPOINT_URL",
+	"ecs-endpoint":      "AWS_ENDPOINT_URL",
+}
+
+// flagAliases maps the alias flags sharing the value of another flag to it
+var flagAliases = map[string]string{
+	"endpoint-url": "endpoint",
+}
+
+// setFlagsFromEnv sets the flags not given on the command line from envFlags
+func setFlagsFromEnv() error {
+	given := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) {
+		given[f.Name] = true
+		if name, ok := flagAliases[f.Name]; ok {
+			given[name] = true
+		}
+	})
+	for name, env := range envFlags {
+		v := os.Getenv(env)
+		if given[name] || v == "" {
+			continue
+		}
+		if err := flag.Set(name, v); err != nil {
+			return fmt.Errorf("invalid %s: %s", env, err)
+		}
+	}
+	return nil
+}
+
 // Do the plugin
 func Do() {
+	startedAt := time.Now()
+
 	optAccessKeyID := flag.String("access-key-id", "", "AWS Access Key ID")
 	optSecretAccessKey := flag.String("secret-access-key", "", "AWS Secret Access Key")
-	optClusterName := flag.String("cluster-name", "", "Cluster name")
-	optServiceName := flag.String("service-name", "", "Service name")
+	optProfile := flag.String("profile", "", "Name of the shared credentials profile, whose region is used without -region. -access-key-id and -secret-access-key take precedence over it")
+	optSharedCredentialsFile := flag.String("shared-credentials-file", "", "Path to the shared credentials file of -profile instead of ~/.aws/credentials (%USERPROFILE%\\.aws\\credentials on Windows), e.g. for mackerel-agent running as a service")
+	optAssumeRoleARN := flag.String("assume-role-arn", "", "ARN of an IAM role to assume via STS before querying AWS (the access key, if given, is used to assume it)")
+	optRoleARN := flag.String("role-arn", "", "Alias of -assume-role-arn")
+	optExternalID := flag.String("external-id", "", "External ID to assume the role of -assume-role-arn with")
+	optClusterName := flag.String("cluster-name", "", "Cluster name, or comma separated cluster names (required)")
+	optServiceName := flag.String("service-name", "", "Service name, or comma separated service names")
+	optTaskDefinitionFamily := flag.String("task-definition-family", "", "Task definition family to emit the CPU/memory usage of from Container Insights, instead of a service")
+	optAllServices := flag.Bool("all-services", false, "Emit the metrics of every service of the cluster, listed with the ECS API on each run")
+	var optFilterTags, optExcludeTags stringsFlag
+	flag.Var(&optFilterTags, "filter-tag", "With all-services or emit-cluster-totals, only the services tagged Key=Value (repeatable, all must match)")
+	flag.Var(&optExcludeTags, "exclude-tag", "With all-services or emit-cluster-totals, leave out the services tagged Key=Value (repeatable, any matches)")
+	optSelect := flag.String("select", "", "Experimental: monitor all services of the cluster matching the comma separated tag:Key=Value and tag:Key!=Value terms (implies all-services)")
 	optPrefix := flag.String("metric-key-prefix", "ECS", "Metric key prefix")
-	optRegion := flag.String("region", "", "AWS region")
+	optPrefixMap := flag.String("prefix-map", "", "Comma separated cluster[/service]=prefix entries of the metric key prefixes of the clusters or services, falling back to metric-key-prefix")
+	optRegion := flag.String("region", "", "AWS region (detected from the EC2 instance metadata if empty)")
+	optLaunchType := flag.String("launch-type", launchTypeEC2, "Launch type of the cluster: ec2 (EC2 or mixed) or fargate (Fargate only, omits the reservation graphs and adds the Container Insights ephemeral storage and network graphs)")
+	optFallbackRegion := flag.String("fallback-region", "", "AWS region to use when the primary region returns no data for the cluster")
+	optEndpoint := flag.String("endpoint", "", "CloudWatch endpoint URL, e.g. of a VPC endpoint or LocalStack")
+	flag.StringVar(optEndpoint, "endpoint-url", "", "Alias of -endpoint")
+	optNamespace := flag.String("namespace", namespace, "CloudWatch namespace of the ECS metrics, e.g. a custom namespace which the CloudWatch agent publishes them to")
+	var optDimensions stringsFlag
+	flag.Var(&optDimensions, "dimension", "Extra Name=Value dimension of the metrics of -namespace besides ClusterName and ServiceName (repeatable)")
+	optECSEndpoint := flag.String("ecs-endpoint", "", "ECS endpoint URL, e.g. of a VPC endpoint or LocalStack")
+	optEndpointMap := flag.String("endpoint-map", "", "Path to a file of region=url lines overriding the CloudWatch endpoint per region")
+	optEmitUtilizationBands := flag.Bool("emit-utilization-bands", false, "Emit the percentage of CPUUtilization datapoints in each utilization band")
+	optUtilizationBands := flag.String("utilization-bands", "25,50,75", "Comma separated boundaries of the utilization bands")
+	optGPU := flag.Bool("gpu", false, "Emit GPUReservation of the cluster with GPU instances")
+	optWithGPU := flag.Bool("with-gpu", false, "Alias of -gpu")
+	optContainerInsights := flag.Bool("container-insights", false, "Emit the task counts, task utilization and network/storage usage from Container Insights (ECS/ContainerInsights)")
+	optEnableContainerLevel := flag.Bool("enable-container-level", false, "Emit per-container CPU/memory utilization from Container Insights (requires -service-name)")
+	optExposeSampleCounts := flag.Bool("expose-sample-counts", false, "Emit the SampleCount of CPUUtilization summed over the window as a meta metric")
+	optMetricStreamFile := flag.String("metric-stream-file", "", "Read the metrics from a file of CloudWatch Metric Stream JSON records instead of the CloudWatch API")
+	optCheckPrefixCollision := flag.Bool("check-prefix-collision", false, "Fail when another plugin instance uses the same metric key prefix for the same cluster/service")
+	optDebug := flag.Bool("debug", false, "Log debug messages such as the credentials provider in use and a JSON summary of each CloudWatch query")
+	optActiveHours := flag.String("active-hours", "", "Collect metrics only within this daily window, e.g. 09:00-18:00")
+	optActiveTimezone := flag.String("active-timezone", "", "Timezone of -active-hours such as Asia/Tokyo (default: local timezone)")
+	optOutput := flag.String("output", "mackerel", "Output format: mackerel or prometheus")
+	optListenAddr := flag.String("listen-addr", "", "With -output=prometheus, serve a single scrape of /metrics at this address instead of printing")
+	optOutputSocket := flag.String("output-socket", "", "Path to a Unix domain socket to write the metrics to instead of stdout")
+	optTargetGroupARN := flag.String("lb-target-group-arn", "", "ARN of the load balancer target group of the service to emit healthy/unhealthy target counts for")
+	optEmitCapacityProviders := flag.Bool("emit-capacity-providers", false, "Emit the registered container instances of the cluster, and the attached instances and CapacityProviderReservation of each Auto Scaling group capacity provider")
+	optWithContainerInstances := flag.Bool("with-container-instances", false, "Emit the registered and remaining CPU and memory of each container instance of the cluster and their totals via the ECS API")
+	optEmitTaskEvents := flag.Bool("emit-task-events", false, "Emit the service events, the placement failures and the stopped tasks by their stop reason (e.g. OOM) of the services since the last run via the ECS API")
+	optEmitAutoscaling := flag.Bool("emit-autoscaling", false, "Emit the min and max capacity of the service from Application Auto Scaling with its desired count")
+	optIncludeClusterReservation := flag.Bool("include-cluster-reservation", false, "With service-name, all-services or task-definition-family, also emit the CPU/memory (and GPU) reservation graphs of the cluster")
+	optEmitServiceRollup := flag.Bool("emit-service-rollup", false, "With all-services or multiple services, also emit the task counts summed over the services")
+	optRollupAggregations := flag.String("rollup-aggregations", "", "Comma separated metric=sum or metric=avg overrides of how -emit-service-rollup rolls up the metrics, e.g. TaskDesired=avg (implies -emit-service-rollup)")
+	optTopN := flag.Int("top-n", 0, "With all-services or multiple services, also emit the CPUUtilization of the N services of the most CPU utilization (0 to disable)")
+	optEmitClusterTotals := flag.Bool("emit-cluster-totals", false, "Emit the running/pending/desired task counts summed over all services of the cluster via the ECS API")
+	optMaxRetries := flag.Int("max-retries", defaultMaxRetries, "Max number of retries of throttled or failed AWS API requests")
+	optRetryThrottleDelay := flag.Duration("retry-throttle-delay", client.DefaultRetryerMinThrottleDelay, "Initial backoff of a throttled AWS API request, doubled on each retry")
+	optRetryMaxDelay := flag.Duration("retry-max-delay", client.DefaultRetryerMaxRetryDelay, "Max backoff between the retries of an AWS API request")
+	optTimeout := flag.Duration("timeout", defaultTimeout, "Timeout of an AWS API request")
+	optStatistics := flag.String("statistics", strings.Join(defaultStatistics, ","), "Comma separated statistics of the CloudWatch metrics to emit (Average, Minimum, Maximum, Sum, SampleCount)")
+	optExtendedStatistics := flag.String("extended-statistics", "", "Comma separated percentiles of the per-task Container Insights metrics to emit, e.g. p50,p90,p99")
+	optMaxConcurrency := flag.Int("max-concurrency", 0, "Max number of concurrent AWS API requests (0 for auto: the number of requests of the run, up to twice the number of CPUs)")
+	optDiscoveryCacheTTL := flag.Duration("discovery-cache-ttl", defaultDiscoveryCacheTTL, "How long the services listed with the ECS API for -all-services and -emit-cluster-totals are cached (0 to disable)")
+	optFetchDeadline := flag.Duration("fetch-deadline", 0, "Deadline of fetching all the metrics, after which the metrics fetched so far are emitted (0 to disable)")
+	optPeriod := flag.Int("period", int(defaultPeriod/time.Second), "Period of the CloudWatch datapoints in seconds")
+	optLookback := flag.Int("lookback", int(defaultLookback/time.Second), "Window to look back for the CloudWatch datapoints in seconds (at least period)")
+	optDatapointLag := flag.Int("datapoint-lag", 0, "Report the most recent datapoint at least this many seconds old instead of the least recent one in the window (0 to disable)")
+	optZeroGrace := flag.Int("zero-grace-seconds", 0, "Report 0 running tasks of a service only after it has been at zero for this many seconds, leaving the metric out until then (0 to disable)")
+	optTrimmedMeanPercent := flag.Float64("trimmed-mean-percent", 0, "Report the Average statistic as the mean of the datapoints in the window after discarding this percent of the highest and lowest ones")
+	optNoStacking := flag.Bool("no-stacking", false, "Don't stack the metrics of count and band graphs")
+	optEmitSelfMetrics := flag.Bool("emit-self-metrics", false, "Emit the plugin's own memory usage and runtime as meta metrics")
+	optSource := flag.String("source", sourceCloudWatch, "Source of the metrics: cloudwatch, or metadata (the CPU, memory, network and block I/O of each container of the task the plugin runs in, from the Task Metadata Endpoint v4)")
+	optTaskCountSource := flag.String("task-count-source", taskCountECS, "Source of the task counts of the services: ecs (DescribeServices) or cloudwatch (the running tasks only, from the SampleCount of CPUUtilization)")
+	optFillMissing := flag.String("fill-missing", fillSkip, "How to report a CloudWatch metric without datapoints in the window: skip, zero, or last (the value reported last time)")
+	optEmitChangedOnly := flag.Bool("emit-changed-only", false, "Emit only the metrics whose value changed since the last emitted one")
+	optEmitDatapointTime := flag.Bool("emit-datapoint-time", false, "Emit each CloudWatch value at the time of its datapoint instead of now, skipping the datapoints already emitted by the last run")
+	optChangedEpsilon := flag.Float64("changed-epsilon", 0, "Changes up to this amount are treated as unchanged with -emit-changed-only")
+	optSanityCheck := flag.Bool("sanity-check", false, "Drop values out of the sane bounds of their graph (0-100 for percentage graphs)")
+	optSanityBounds := flag.String("sanity-bounds", "", "Comma separated graph=min:max bounds overriding the defaults of -sanity-check (implies -sanity-check)")
+	optEmitMetaMetrics := flag.Bool("emit-meta-metrics", false, "Emit the latency of the longest CloudWatch GetMetricData request of the run as a meta metric")
+	optConfig := flag.String("config", "", "Path to a JSON file of the targets to collect in a single run, each with the flags overriding the command line")
+	optValidate := flag.Bool("validate", false, "Check the credentials, the region, the clusters and services, and the IAM permissions the options require, print a report, and exit non-zero on a failure")
+	optVersion := flag.Bool("version", false, "Print the version and exit")
 	flag.Parse()
 
-	var plugin ECSPlugin
+	if *optVersion {
+		printVersion(os.Stdout)
+		return
+	}
+	if err := setFlagsFromEnv(); err != nil {
+		log.Fatalln(err)
+	}
 
-	plugin.AccessKeyID = *optAccessKeyID
-	plugin.SecretAccessKey = *optSecretAccessKey
-	plugin.ClusterName = *optClusterName
-	plugin.ServiceName = *optServiceName
-	plugin.Prefix = *optPrefix
-	plugin.Region = *optRegion
+	// Emit whatever has been collected instead of being killed mid-write.
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
 
-	err := plugin.prepare()
-	if err != nil {
-		log.Fatalln(err)
+	// newPlugin builds the plugin from the flags, which -config sets for each target
+	newPlugin := func() ECSPlugin {
+		var plugin ECSPlugin
+
+		plugin.StartedAt = startedAt
+		plugin.Debug = *optDebug
+		plugin.ctx = ctx
+
+		plugin.AccessKeyID = *optAccessKeyID
+		plugin.SecretAccessKey = *optSecretAccessKey
+		plugin.Profile = *optProfile
+		plugin.SharedCredentialsFile = *optSharedCredentialsFile
+		plugin.AssumeRoleARN = *optAssumeRoleARN
+		if plugin.AssumeRoleARN == "" {
+			plugin.AssumeRoleARN = *optRoleARN
+		}
+		plugin.ExternalID = *optExternalID
+		plugin.ClusterName = *optClusterName
+		plugin.ServiceName = *optServiceName
+		plugin.Prefix = *optPrefix
+		prefixMap, err := parsePrefixMap(*optPrefixMap)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		plugin.PrefixMap = prefixMap
+		plugin.Region = *optRegion
+		plugin.Namespace = *optNamespace
+		dimensions, err := parseDimensions(optDimensions)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		plugin.ExtraDimensions = dimensions
+		plugin.LaunchType = *optLaunchType
+		plugin.FallbackRegion = *optFallbackRegion
+		plugin.Endpoint = *optEndpoint
+		plugin.ECSEndpoint = *optECSEndpoint
+		plugin.EndpointMapFile = *optEndpointMap
+		plugin.MetricStreamFile = *optMetricStreamFile
+		plugin.EmitSelfMetrics = *optEmitSelfMetrics
+		plugin.EmitMetaMetrics = *optEmitMetaMetrics
+		plugin.ExposeSampleCounts = *optExposeSampleCounts
+		plugin.EmitChangedOnly = *optEmitChangedOnly
+		plugin.FillMissing = *optFillMissing
+		plugin.Source = *optSource
+		plugin.TaskCountSource = *optTaskCountSource
+		plugin.ChangedEpsilon = *optChangedEpsilon
+		plugin.EmitDatapointTime = *optEmitDatapointTime
+		sanityBounds, err := parseSanityBounds(*optSanityBounds)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		plugin.SanityCheck = *optSanityCheck || len(sanityBounds) > 0
+		plugin.SanityBounds = sanityBounds
+		plugin.EnableContainerLevel = *optEnableContainerLevel
+		plugin.ContainerInsights = *optContainerInsights
+		plugin.GPU = *optGPU || *optWithGPU
+		plugin.EmitUtilizationBands = *optEmitUtilizationBands
+		plugin.NoStacking = *optNoStacking
+		plugin.MaxRetries = *optMaxRetries
+		plugin.RetryThrottleDelay = *optRetryThrottleDelay
+		plugin.RetryMaxDelay = *optRetryMaxDelay
+		plugin.Timeout = *optTimeout
+		plugin.FetchDeadline = *optFetchDeadline
+		plugin.DiscoveryCacheTTL = *optDiscoveryCacheTTL
+		plugin.MaxConcurrency = *optMaxConcurrency
+		statistics, err := parseStatistics(*optStatistics)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		plugin.Statistics = statistics
+		plugin.ExtendedStatistics, err = parseExtendedStatistics(*optExtendedStatistics)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		plugin.Period = time.Duration(*optPeriod) * time.Second
+		plugin.Lookback = time.Duration(*optLookback) * time.Second
+		plugin.DatapointLag = time.Duration(*optDatapointLag) * time.Second
+		plugin.ZeroGrace = time.Duration(*optZeroGrace) * time.Second
+		plugin.TrimmedMeanPercent = *optTrimmedMeanPercent
+		plugin.EmitClusterTotals = *optEmitClusterTotals
+		plugin.TopN = *optTopN
+		rollupAggregations, err := parseRollupAggregations(*optRollupAggregations)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		plugin.EmitServiceRollup = *optEmitServiceRollup || len(rollupAggregations) > 0
+		plugin.RollupAggregations = rollupAggregations
+		plugin.EmitCapacityProviders = *optEmitCapacityProviders
+		plugin.EmitAutoscaling = *optEmitAutoscaling
+		plugin.EmitTaskEvents = *optEmitTaskEvents
+		plugin.IncludeClusterReservation = *optIncludeClusterReservation
+		plugin.WithContainerInstances = *optWithContainerInstances
+		plugin.TargetGroupARN = *optTargetGroupARN
+		plugin.AllServices = *optAllServices
+		plugin.FilterTags, err = parseTags(optFilterTags)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		plugin.ExcludeTags, err = parseTags(optExcludeTags)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		if *optSelect != "" {
+			if plugin.ServiceName != "" || *optTaskDefinitionFamily != "" {
+				log.Fatalln("select cannot be used with service-name or task-definition-family")
+			}
+			include, exclude, err := parseSelector(*optSelect)
+			if err != nil {
+				log.Fatalln(err)
+			}
+			if err := mergeTags(plugin.FilterTags, include); err != nil {
+				log.Fatalln(err)
+			}
+			if err := mergeTags(plugin.ExcludeTags, exclude); err != nil {
+				log.Fatalln(err)
+			}
+			plugin.AllServices = true
+		}
+		plugin.TaskDefinitionFamily = *optTaskDefinitionFamily
+		if plugin.EmitUtilizationBands {
+			boundaries, err := parseUtilizationBands(*optUtilizationBands)
+			if err != nil {
+				log.Fatalln(err)
+			}
+			plugin.UtilizationBandBoundaries = boundaries
+		}
+		if err := plugin.checkOptions(); err != nil {
+			log.Fatalln(err)
+		}
+		return plugin
 	}
 
-	helper := mp.NewMackerelPlugin(plugin)
+	if *optOutput != "mackerel" && *optOutput != "prometheus" {
+		log.Fatalf("unknown output format: %s", *optOutput)
+	}
 
-	helper.Run()
+	if *optActiveHours != "" && os.Getenv("MACKEREL_AGENT_PLUGIN_META") == "" {
+		hours, err := parseActiveHours(*optActiveHours, *optActiveTimezone)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		if !hours.contains(time.Now()) {
+			// outside the active hours: emit nothing and make no API calls
+			return
+		}
+	}
+
+	var plugins []ECSPlugin
+	if *optConfig != "" {
+		if *optOutput == "prometheus" {
+			log.Fatalln("config cannot be used with output prometheus")
+		}
+		var err error
+		plugins, err = configuredPlugins(*optConfig, newPlugin)
+		if err != nil {
+			log.Fatalln(err)
+		}
+	} else {
+		plugins = []ECSPlugin{newPlugin()}
+	}
+	// the targets mapped to the prefixes of prefix-map are collected as targets of their own
+	var split []ECSPlugin
+	mapped := false
+	for _, p := range plugins {
+		mapped = mapped || len(p.PrefixMap) > 0
+		ps, err := p.splitByPrefixMap()
+		if err != nil {
+			log.Fatalln(err)
+		}
+		split = append(split, ps...)
+	}
+	if mapped {
+		if err := checkUniquePrefixes(split); err != nil {
+			log.Fatalln(err)
+		}
+		if len(split) > 1 && *optOutput == "prometheus" {
+			log.Fatalln("prefix-map cannot be used with output prometheus")
+		}
+	}
+	plugins = split
+
+	if *optValidate {
+		ok := true
+		for i := range plugins {
+			if len(plugins) > 1 {
+				fmt.Printf("%s:\n", plugins[i].MetricKeyPrefix())
+			}
+			if err := plugins[i].prepare(); err != nil {
+				fmt.Printf("[FAIL] %s\n", err)
+				ok = false
+				continue
+			}
+			if !plugins[i].validate(os.Stdout) {
+				ok = false
+			}
+		}
+		if !ok {
+			os.Exit(1)
+		}
+		return
+	}
+
+	for i := range plugins {
+		if *optCheckPrefixCollision {
+			if err := plugins[i].checkPrefixCollision(); err != nil {
+				log.Fatalln(err)
+			}
+		}
+		if err := plugins[i].prepare(); err != nil {
+			log.Fatalln(err)
+		}
+	}
+
+	if *optOutputSocket != "" {
+		out, err := dialOutputSocket(*optOutputSocket)
+		if err != nil {
+			log.Fatalf("failed to connect to the output socket %s: %s", *optOutputSocket, err)
+		}
+		defer func() {
+			if err := out.Close(); err != nil {
+				log.Printf("failed to write to the output socket %s: %s", *optOutputSocket, err)
+			}
+		}()
+		// go-mackerel-plugin writes to os.Stdout
+		os.Stdout = out.File
+	}
+
+	if len(plugins) > 1 {
+		multiPlugin(plugins).run()
+		return
+	}
+	plugin := plugins[0]
+	var err error
+	if *optOutput == "prometheus" {
+		if *optListenAddr != "" {
+			err = plugin.servePrometheusOnce(*optListenAddr)
+		} else {
+			err = plugin.writePrometheus(os.Stdout)
+		}
+		if err != nil {
+			log.Fatalln(err)
+		}
+		return
+	}
+
+	plugin.run()
+}
+
+// outputSocket copies what is written to its pipe to a Unix domain socket.
+// go-mackerel-plugin writes to os.Stdout, which is replaced with the pipe,
+// while (*net.UnixConn).File to replace it with the socket is unsupported on Windows.
+type outputSocket struct {
+	*os.File
+	conn net.Conn
+	done chan error
+}
+
+func dialOutputSocket(path string) (*outputSocket, error) {
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	r, w, err := os.Pipe()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	s := &outputSocket{File: w, conn: conn, done: make(chan error, 1)}
+	go func() {
+		_, err := io.Copy(conn, r)
+		r.Close()
+		s.done <- err
+	}()
+	return s, nil
+}
+
+// Close flushes what was written to the socket and closes it
+func (s *outputSocket) Close() error {
+	s.File.Close()
+	err := <-s.done
+	if cerr := s.conn.Close(); err == nil {
+		err = cerr
+	}
+	return err
 }
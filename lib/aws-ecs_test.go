@@ -0,0 +1,944 @@
+package mpawsecs
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/client"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+	"github.com/aws/aws-sdk-go/service/cloudwatch/cloudwatchiface"
+	"github.com/aws/aws-sdk-go/service/ecs"
+	"github.com/aws/aws-sdk-go/service/ecs/ecsiface"
+	mp "github.com/mackerelio/go-mackerel-plugin"
+)
+
+// point is a datapoint of fakeCloudWatch
+type point struct {
+	t time.Time
+	v float64
+}
+
+// fakeCloudWatch answers GetMetricData with the points of each query keyed by fakeKey
+type fakeCloudWatch struct {
+	cloudwatchiface.CloudWatchAPI
+	points map[string][]point
+	// the keys of the queries whose results have StatusCode InternalError
+	internalErrors map[string]bool
+	// the error of every request
+	err error
+	// before is called on each request, e.g. to cancel the collection
+	before func()
+
+	mu       sync.Mutex
+	requests int
+}
+
+// fakeKey is "<metric> <statistic>", prefixed by "<service> " for the queries of a service
+func fakeKey(q *cloudwatch.MetricDataQuery) string {
+	key := aws.StringValue(q.MetricStat.Metric.MetricName) + " " + aws.StringValue(q.MetricStat.Stat)
+	for _, d := range q.MetricStat.Metric.Dimensions {
+		if aws.StringValue(d.Name) == "ServiceName" {
+			key = aws.StringValue(d.Value) + " " + key
+		}
+	}
+	return key
+}
+
+func (c *fakeCloudWatch) GetMetricDataPagesWithContext(ctx aws.Context, input *cloudwatch.GetMetricDataInput, fn func(*cloudwatch.GetMetricDataOutput, bool) bool, _ ...request.Option) error {
+	c.mu.Lock()
+	c.requests++
+	c.mu.Unlock()
+	if c.before != nil {
+		c.before()
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if c.err != nil {
+		return c.err
+	}
+
+	page := &cloudwatch.GetMetricDataOutput{}
+	for _, q := range input.MetricDataQueries {
+		key := fakeKey(q)
+		r := &cloudwatch.MetricDataResult{Id: q.Id, StatusCode: aws.String(cloudwatch.StatusCodeComplete)}
+		if c.internalErrors[key] {
+			r.StatusCode = aws.String(cloudwatch.StatusCodeInternalError)
+		}
+		// in descending order, which getMetricData has to sort
+		points := c.points[key]
+		for i := len(points) - 1; i >= 0; i-- {
+			r.Timestamps = append(r.Timestamps, aws.Time(points[i].t))
+			r.Values = append(r.Values, aws.Float64(points[i].v))
+		}
+		page.MetricDataResults = append(page.MetricDataResults, r)
+	}
+	fn(page, true)
+	return nil
+}
+
+// fakeECS answers the ECS API with the services of a cluster
+type fakeECS struct {
+	ecsiface.ECSAPI
+	// the services of the cluster by name
+	services map[string]*ecs.Service
+	// the tags of the services by name
+	tags map[string]map[string]string
+	// the services which DescribeServices reports as failures
+	missing map[string]bool
+	// the requests of DescribeServices including these services fail
+	failing map[string]bool
+	// before is called on each request of DescribeServices, e.g. to cancel the collection
+	before func()
+	// the stopped tasks of the services by name
+	stopped map[string][]*ecs.Task
+	// the services whose stopped tasks fail to list
+	failingTasks map[string]bool
+}
+
+func serviceARN(name string) string {
+	return "arn:aws:ecs:ap-northeast-1:123456789012:service/test/" + name
+}
+
+func newService(name string, running, pending, desired int64) *ecs.Service {
+	return &ecs.Service{
+		ServiceName:  aws.String(name),
+		ServiceArn:   aws.String(serviceARN(name)),
+		Status:       aws.String("ACTIVE"),
+		RunningCount: aws.Int64(running),
+		PendingCount: aws.Int64(pending),
+		DesiredCount: aws.Int64(desired),
+		Deployments: []*ecs.Deployment{
+			{Status: aws.String("PRIMARY"), RolloutState: aws.String(ecs.DeploymentRolloutStateCompleted)},
+		},
+	}
+}
+
+func (c *fakeECS) ListServicesPagesWithContext(ctx aws.Context, input *ecs.ListServicesInput, fn func(*ecs.ListServicesOutput, bool) bool, _ ...request.Option) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	var arns []string
+	for name := range c.services {
+		arns = append(arns, serviceARN(name))
+	}
+	for name := range c.missing {
+		arns = append(arns, serviceARN(name))
+	}
+	sort.Strings(arns)
+	fn(&ecs.ListServicesOutput{ServiceArns: aws.StringSlice(arns)}, true)
+	return nil
+}
+
+func (c *fakeECS) DescribeServicesWithContext(ctx aws.Context, input *ecs.DescribeServicesInput, _ ...request.Option) (*ecs.DescribeServicesOutput, error) {
+	if c.before != nil {
+		c.before()
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	out := &ecs.DescribeServicesOutput{}
+	for _, s := range aws.StringValueSlice(input.Services) {
+		// a name or an ARN
+		name := s[strings.LastIndex(s, "/")+1:]
+		if c.failing[name] {
+			return nil, errors.New("ServerException: internal error")
+		}
+		service, ok := c.services[name]
+		if !ok || c.missing[name] {
+			out.Failures = append(out.Failures, &ecs.Failure{Arn: aws.String(serviceARN(name)), Reason: aws.String("MISSING")})
+			continue
+		}
+		out.Services = append(out.Services, service)
+	}
+	return out, nil
+}
+
+func (c *fakeECS) ListTasksPagesWithContext(ctx aws.Context, input *ecs.ListTasksInput, fn func(*ecs.ListTasksOutput, bool) bool, _ ...request.Option) error {
+	service := aws.StringValue(input.ServiceName)
+	if c.failingTasks[service] {
+		return errors.New("ThrottlingException: rate exceeded")
+	}
+	var arns []string
+	for _, t := range c.stopped[service] {
+		arns = append(arns, aws.StringValue(t.TaskArn))
+	}
+	fn(&ecs.ListTasksOutput{TaskArns: aws.StringSlice(arns)}, true)
+	return nil
+}
+
+func (c *fakeECS) ListTasksWithContext(ctx aws.Context, input *ecs.ListTasksInput, _ ...request.Option) (*ecs.ListTasksOutput, error) {
+	var out *ecs.ListTasksOutput
+	err := c.ListTasksPagesWithContext(ctx, input, func(page *ecs.ListTasksOutput, _ bool) bool {
+		out = page
+		return false
+	})
+	if err != nil {
+		return nil, err
+	}
+	if max := int(aws.Int64Value(input.MaxResults)); max > 0 && len(out.TaskArns) > max {
+		out.TaskArns = out.TaskArns[:max]
+	}
+	return out, nil
+}
+
+func (c *fakeECS) DescribeTasksWithContext(ctx aws.Context, input *ecs.DescribeTasksInput, _ ...request.Option) (*ecs.DescribeTasksOutput, error) {
+	out := &ecs.DescribeTasksOutput{}
+	for _, arn := range aws.StringValueSlice(input.Tasks) {
+		for _, tasks := range c.stopped {
+			for _, t := range tasks {
+				if aws.StringValue(t.TaskArn) == arn {
+					out.Tasks = append(out.Tasks, t)
+				}
+			}
+		}
+	}
+	return out, nil
+}
+
+func (c *fakeECS) ListTagsForResourceWithContext(ctx aws.Context, input *ecs.ListTagsForResourceInput, _ ...request.Option) (*ecs.ListTagsForResourceOutput, error) {
+	arn := aws.StringValue(input.ResourceArn)
+	out := &ecs.ListTagsForResourceOutput{}
+	for k, v := range c.tags[arn[strings.LastIndex(arn, "/")+1:]] {
+		out.Tags = append(out.Tags, &ecs.Tag{Key: aws.String(k), Value: aws.String(v)})
+	}
+	return out, nil
+}
+
+// newTestPlugin returns the plugin of the cluster "test" querying the fakes,
+// whose state files are kept in a temporary directory of the test
+func newTestPlugin(t *testing.T, cw *fakeCloudWatch, e *fakeECS) ECSPlugin {
+	t.Helper()
+	t.Setenv("MACKEREL_PLUGIN_WORKDIR", t.TempDir())
+	return ECSPlugin{
+		ClusterName:        "test",
+		Prefix:             "ECS",
+		Region:             "ap-northeast-1",
+		LaunchType:         launchTypeEC2,
+		Source:             sourceCloudWatch,
+		TaskCountSource:    taskCountECS,
+		FillMissing:        fillSkip,
+		Period:             defaultPeriod,
+		Lookback:           defaultLookback,
+		MaxRetries:         defaultMaxRetries,
+		RetryThrottleDelay: client.DefaultRetryerMinThrottleDelay,
+		RetryMaxDelay:      client.DefaultRetryerMaxRetryDelay,
+		Timeout:            defaultTimeout,
+		CloudWatch:         cw,
+		ECS:                e,
+	}
+}
+
+// minutesAgo returns the points of the values, the first one the least recent and the last one a minute ago
+func minutesAgo(values ...float64) []point {
+	now := time.Now().Truncate(time.Minute)
+	points := make([]point, len(values))
+	for i, v := range values {
+		points[i] = point{now.Add(-time.Duration(len(values)-i) * time.Minute), v}
+	}
+	return points
+}
+
+func TestGetMetricData(t *testing.T) {
+	errRequest := errors.New("Throttling: Rate exceeded")
+	cpu := metrics{"CPUUtilization", metricsTypeAverage}
+	memory := metrics{"MemoryUtilization", metricsTypeAverage}
+
+	tests := []struct {
+		name       string
+		cw         *fakeCloudWatch
+		wantValues [][]float64
+		wantErrs   []error
+	}{
+		{
+			name: "sorted in ascending order",
+			cw: &fakeCloudWatch{points: map[string][]point{
+				"CPUUtilization Average":    minutesAgo(10, 20, 30),
+				"MemoryUtilization Average": minutesAgo(40),
+			}},
+			wantValues: [][]float64{{10, 20, 30}, {40}},
+			wantErrs:   []error{nil, nil},
+		},
+		{
+			name: "missing datapoints",
+			cw: &fakeCloudWatch{points: map[string][]point{
+				"CPUUtilization Average": minutesAgo(10),
+			}},
+			wantValues: [][]float64{{10}, nil},
+			wantErrs:   []error{nil, errNoDatapoints},
+		},
+		{
+			name:       "failed request",
+			cw:         &fakeCloudWatch{err: errRequest},
+			wantValues: [][]float64{nil, nil},
+			wantErrs:   []error{errRequest, errRequest},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newTestPlugin(t, tt.cw, nil)
+			results, errs := p.getMetricData([]query{p.query(cpu), p.query(memory)})
+			for i := range results {
+				if !reflect.DeepEqual(results[i].values, tt.wantValues[i]) {
+					t.Errorf("values[%d] = %v, want %v", i, results[i].values, tt.wantValues[i])
+				}
+				if !sort.IsSorted(results[i]) {
+					t.Errorf("timestamps[%d] = %v, want ascending", i, results[i].timestamps)
+				}
+				if !errors.Is(errs[i], tt.wantErrs[i]) {
+					t.Errorf("errs[%d] = %v, want %v", i, errs[i], tt.wantErrs[i])
+				}
+			}
+		})
+	}
+}
+
+func TestGetMetricDataInternalError(t *testing.T) {
+	cw := &fakeCloudWatch{
+		points:         map[string][]point{"CPUUtilization Average": minutesAgo(10)},
+		internalErrors: map[string]bool{"CPUUtilization Average": true},
+	}
+	p := newTestPlugin(t, cw, nil)
+	_, errs := p.getMetricData([]query{p.query(metrics{"CPUUtilization", metricsTypeAverage})})
+	if errs[0] == nil || !strings.HasPrefix(errs[0].Error(), cloudwatch.StatusCodeInternalError) {
+		t.Errorf("err = %v, want %s", errs[0], cloudwatch.StatusCodeInternalError)
+	}
+}
+
+func TestLastPoint(t *testing.T) {
+	now := time.Now()
+	s := series{
+		timestamps: []time.Time{now.Add(-5 * time.Minute), now.Add(-4 * time.Minute), now.Add(-3 * time.Minute), now.Add(-2 * time.Minute), now.Add(-time.Minute)},
+		values:     []float64{10, 20, 30, 40, 100},
+	}
+
+	tests := []struct {
+		name               string
+		metric             string
+		datapointLag       time.Duration
+		trimmedMeanPercent float64
+		want               float64
+	}{
+		{name: "least recent", metric: metricsTypeMaximum, want: 10},
+		{name: "datapoint lag", metric: metricsTypeMaximum, datapointLag: 150 * time.Second, want: 30},
+		{name: "datapoint lag beyond the window", metric: metricsTypeMaximum, datapointLag: time.Hour, want: 10},
+		{name: "trimmed mean of Average", metric: metricsTypeAverage, trimmedMeanPercent: 20, want: 30},
+		{name: "no trimmed mean of Minimum", metric: metricsTypeMinimum, trimmedMeanPercent: 20, want: 10},
+		{name: "no trimmed mean of SampleCount", metric: metricsTypeSampleCount, trimmedMeanPercent: 20, datapointLag: 90 * time.Second, want: 40},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := ECSPlugin{DatapointLag: tt.datapointLag, TrimmedMeanPercent: tt.trimmedMeanPercent}
+			if got := p.lastPoint(s, metrics{"CPUUtilization", tt.metric}); got != tt.want {
+				t.Errorf("lastPoint() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFetchMetrics(t *testing.T) {
+	cw := &fakeCloudWatch{points: map[string][]point{
+		"web CPUUtilization Average":     minutesAgo(20, 30, 40),
+		"web CPUUtilization Minimum":     minutesAgo(5, 6, 7),
+		"web CPUUtilization Maximum":     minutesAgo(50, 60, 70),
+		"web CPUUtilization SampleCount": minutesAgo(3, 3, 3),
+		"web MemoryUtilization Average":  minutesAgo(45, 46, 47),
+		"web MemoryUtilization Maximum":  minutesAgo(55, 56, 57),
+	}}
+	e := &fakeECS{services: map[string]*ecs.Service{"web": newService("web", 2, 1, 3)}}
+	tasks := map[string]float64{
+		"TaskRunning":       2,
+		"TaskPending":       1,
+		"TaskDesired":       3,
+		"DeploymentCount":   1,
+		"DeploymentPrimary": 1,
+		"DeploymentActive":  0,
+		"RolloutInProgress": 0,
+		"RolloutCompleted":  1,
+		"RolloutFailed":     0,
+
+		"DeploymentFailedTasks": 0,
+	}
+
+	tests := []struct {
+		name        string
+		statistics  []string
+		fillMissing string
+		want        map[string]float64
+	}{
+		{
+			name: "default statistics with a missing metric",
+			want: map[string]float64{
+				"CPUUtilizationAverage":    20,
+				"CPUUtilizationMinimum":    5,
+				"CPUUtilizationMaximum":    50,
+				"MemoryUtilizationAverage": 45,
+				"MemoryUtilizationMaximum": 55,
+			},
+		},
+		{
+			name:        "missing metric filled with zero",
+			fillMissing: fillZero,
+			want: map[string]float64{
+				"CPUUtilizationAverage":    20,
+				"CPUUtilizationMinimum":    5,
+				"CPUUtilizationMaximum":    50,
+				"MemoryUtilizationAverage": 45,
+				"MemoryUtilizationMinimum": 0,
+				"MemoryUtilizationMaximum": 55,
+			},
+		},
+		{
+			name:        "statistics",
+			statistics:  []string{metricsTypeMaximum, metricsTypeSampleCount},
+			fillMissing: fillZero,
+			want: map[string]float64{
+				"CPUUtilizationMaximum":        50,
+				"CPUUtilizationSampleCount":    3,
+				"MemoryUtilizationMaximum":     55,
+				"MemoryUtilizationSampleCount": 0,
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newTestPlugin(t, cw, e)
+			p.ServiceName = "web"
+			p.Statistics = tt.statistics
+			if tt.fillMissing != "" {
+				p.FillMissing = tt.fillMissing
+			}
+			want := make(map[string]float64)
+			for k, v := range tt.want {
+				want[k] = v
+			}
+			for k, v := range tasks {
+				want[k] = v
+			}
+
+			got, err := p.FetchMetrics()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("FetchMetrics() = %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestFetchMetricsFailedRequest(t *testing.T) {
+	cw := &fakeCloudWatch{err: errors.New("AccessDenied: not authorized")}
+	e := &fakeECS{services: map[string]*ecs.Service{"web": newService("web", 2, 0, 2)}}
+	p := newTestPlugin(t, cw, e)
+	p.ServiceName = "web"
+	p.FillMissing = fillZero
+
+	got, err := p.FetchMetrics()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a failed request is no missing datapoint to fill
+	for key, v := range got {
+		if strings.HasPrefix(key, "CPUUtilization") || math.IsNaN(v) {
+			t.Errorf("FetchMetrics() has %s = %v, want none of CloudWatch", key, v)
+		}
+	}
+	if got["TaskRunning"] != 2 {
+		t.Errorf("TaskRunning = %v, want 2", got["TaskRunning"])
+	}
+}
+
+func TestFetchMetricsWithoutServices(t *testing.T) {
+	tests := []struct {
+		name       string
+		services   map[string]*ecs.Service
+		filterTags map[string]string
+	}{
+		{name: "no services in the cluster"},
+		{
+			name:       "no services matching the tags",
+			services:   map[string]*ecs.Service{"web": newService("web", 1, 0, 1)},
+			filterTags: map[string]string{"team": "payment"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := &fakeECS{services: tt.services}
+			p := newTestPlugin(t, &fakeCloudWatch{}, e)
+			p.AllServices = true
+			p.FilterTags = tt.filterTags
+			var err error
+			if p.services, err = p.listServiceNames(); err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := p.FetchMetrics()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(got) != 0 {
+				t.Errorf("FetchMetrics() = %v, want no metrics", got)
+			}
+		})
+	}
+}
+
+func TestLabelPrefix(t *testing.T) {
+	tests := []struct {
+		prefix string
+		want   string
+	}{
+		{prefix: "ecs", want: "Ecs"},
+		{prefix: "ecs-prod-web", want: "Ecs Prod Web"},
+		{prefix: "ecs_prod_web", want: "Ecs Prod Web"},
+		{prefix: "ecs_prod-web", want: "Ecs Prod Web"},
+		{prefix: "my__service--", want: "My Service"},
+		{prefix: "ECS", want: "ECS"},
+		{prefix: "ECS-prodWeb", want: "ECS ProdWeb"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.prefix, func(t *testing.T) {
+			p := ECSPlugin{Prefix: tt.prefix}
+			if got := p.labelPrefix(); got != tt.want {
+				t.Errorf("labelPrefix() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDropUnchanged(t *testing.T) {
+	tests := []struct {
+		name    string
+		epsilon float64
+		// the stat of each run and the metrics emitted by the run
+		runs []map[string]float64
+		want []map[string]float64
+	}{
+		{
+			name: "exact comparison",
+			runs: []map[string]float64{
+				{"TaskDesired": 3, "CPUUtilizationAverage": 10},
+				{"TaskDesired": 3, "CPUUtilizationAverage": 10.01},
+				{"TaskDesired": 4, "CPUUtilizationAverage": 10.01},
+			},
+			want: []map[string]float64{
+				{"TaskDesired": 3, "CPUUtilizationAverage": 10},
+				{"CPUUtilizationAverage": 10.01},
+				{"TaskDesired": 4},
+			},
+		},
+		{
+			name:    "within the epsilon",
+			epsilon: 0.5,
+			runs: []map[string]float64{
+				{"CPUUtilizationAverage": 10},
+				{"CPUUtilizationAverage": 10.5},
+				{"CPUUtilizationAverage": 9.6},
+				{"CPUUtilizationAverage": 10.6},
+			},
+			want: []map[string]float64{
+				{"CPUUtilizationAverage": 10},
+				{},
+				{},
+				{"CPUUtilizationAverage": 10.6},
+			},
+		},
+		{
+			// the changes are compared with the last emitted value, so a slow drift is emitted
+			name:    "drift beyond the epsilon",
+			epsilon: 1,
+			runs: []map[string]float64{
+				{"CPUUtilizationAverage": 10},
+				{"CPUUtilizationAverage": 10.6},
+				{"CPUUtilizationAverage": 11.2},
+				{"CPUUtilizationAverage": 11.8},
+			},
+			want: []map[string]float64{
+				{"CPUUtilizationAverage": 10},
+				{},
+				{"CPUUtilizationAverage": 11.2},
+				{},
+			},
+		},
+		{
+			name:    "new metric",
+			epsilon: 1,
+			runs: []map[string]float64{
+				{"TaskRunning": 1},
+				{"TaskRunning": 1, "TaskPending": 0},
+			},
+			want: []map[string]float64{
+				{"TaskRunning": 1},
+				{"TaskPending": 0},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newTestPlugin(t, nil, nil)
+			p.ChangedEpsilon = tt.epsilon
+			for i, stat := range tt.runs {
+				p.dropUnchanged(stat)
+				if !reflect.DeepEqual(stat, tt.want[i]) {
+					t.Errorf("run %d: dropUnchanged() = %v, want %v", i+1, stat, tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestFetchMetricsMetaLatency(t *testing.T) {
+	cw := &fakeCloudWatch{
+		points: map[string][]point{"CPUUtilization Average": minutesAgo(10)},
+		before: func() { time.Sleep(5 * time.Millisecond) },
+	}
+	p := newTestPlugin(t, cw, nil)
+	p.EmitMetaMetrics = true
+
+	got, err := p.FetchMetrics()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for key := range got {
+		if strings.HasPrefix(key, "meta.latency.") {
+			t.Errorf("FetchMetrics() has %s, want no latency per metric", key)
+		}
+	}
+	if v := got["getMetricDataLatency"]; v < 5 {
+		t.Errorf("getMetricDataLatency = %v, want at least 5ms", v)
+	}
+	values := p.metricValues(got)
+	if _, ok := values["ECS.meta.latency.getMetricDataLatency"]; !ok {
+		t.Errorf("metricValues() = %v, want ECS.meta.latency.getMetricDataLatency", values)
+	}
+}
+
+func TestFetchMetricsSelfMetrics(t *testing.T) {
+	cw := &fakeCloudWatch{points: map[string][]point{"CPUUtilization Average": minutesAgo(10)}}
+	p := newTestPlugin(t, cw, nil)
+	p.EmitSelfMetrics = true
+	p.StartedAt = time.Now().Add(-2 * time.Second)
+
+	got, err := p.FetchMetrics()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := got["memorySys"]; v <= 0 {
+		t.Errorf("memorySys = %v, want positive", v)
+	}
+	if v := got["runtimeSeconds"]; v < 2 {
+		t.Errorf("runtimeSeconds = %v, want at least 2", v)
+	}
+	graphs := p.GraphDefinition()
+	if got := graphs["meta.memory"].Unit; got != "bytes" {
+		t.Errorf("unit of meta.memory = %q, want bytes", got)
+	}
+	if got := graphs["meta.runtime"].Unit; got != "seconds" {
+		t.Errorf("unit of meta.runtime = %q, want seconds", got)
+	}
+}
+
+func TestOutputSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "metrics.sock")
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		t.Skipf("no Unix domain sockets: %s", err)
+	}
+	defer l.Close()
+	received := make(chan string, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			received <- err.Error()
+			return
+		}
+		defer conn.Close()
+		b, _ := io.ReadAll(conn)
+		received <- string(b)
+	}()
+
+	out, err := dialOutputSocket(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "ECS.Task.TaskRunning\t2\t1700000000\nECS.Task.TaskDesired\t2\t1700000000\n"
+	for _, line := range strings.SplitAfter(want, "\n") {
+		if _, err := fmt.Fprint(out, line); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := out.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if got := <-received; got != want {
+		t.Errorf("received %q, want %q", got, want)
+	}
+}
+
+func TestOutputValuesCanceled(t *testing.T) {
+	tests := []struct {
+		name string
+		// where the collection is canceled
+		cancelCloudWatch, cancelECS bool
+		want                        []string
+	}{
+		{
+			name:             "during the CloudWatch request",
+			cancelCloudWatch: true,
+		},
+		{
+			name:      "during the ECS request",
+			cancelECS: true,
+			want: []string{
+				"ECS.CPUUtilization.CPUUtilizationAverage",
+				"ECS.MemoryUtilization.MemoryUtilizationAverage",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			cw := &fakeCloudWatch{points: map[string][]point{
+				"web CPUUtilization Average":    minutesAgo(10),
+				"web MemoryUtilization Average": minutesAgo(20),
+			}}
+			e := &fakeECS{services: map[string]*ecs.Service{"web": newService("web", 2, 0, 2)}}
+			// as SIGTERM does
+			if tt.cancelCloudWatch {
+				cw.before = cancel
+			}
+			if tt.cancelECS {
+				e.before = cancel
+			}
+			p := newTestPlugin(t, cw, e)
+			p.ServiceName = "web"
+			p.Statistics = []string{metricsTypeAverage}
+			p.ctx = ctx
+
+			var out bytes.Buffer
+			p.outputValues(&out)
+			if got := outputKeys(out.String()); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("outputValues() emitted %v, want %v", got, tt.want)
+			}
+			// the partial output has no truncated lines
+			for _, line := range strings.SplitAfter(out.String(), "\n") {
+				if line != "" && (!strings.HasSuffix(line, "\n") || len(strings.Split(line, "\t")) != 3) {
+					t.Errorf("outputValues() emitted a broken line %q", line)
+				}
+			}
+		})
+	}
+}
+
+func TestTrimmedMean(t *testing.T) {
+	tests := []struct {
+		name    string
+		values  []float64
+		percent float64
+		want    float64
+	}{
+		{
+			name:    "outliers trimmed",
+			values:  []float64{12, 10, 950, 11, 0, 13, 9, 10, 11, 14},
+			percent: 10,
+			// 0 and 950 are discarded
+			want: 11.25,
+		},
+		{
+			name:    "outliers at both ends",
+			values:  []float64{500, 20, 21, 0.1, 19, 20, 400, 20, 0.2, 20},
+			percent: 20,
+			want:    20,
+		},
+		{
+			name:    "too few to trim",
+			values:  []float64{10, 20, 90},
+			percent: 10,
+			want:    40,
+		},
+		{
+			name:    "the median of three",
+			values:  []float64{1000, 50, 1},
+			percent: 40,
+			want:    50,
+		},
+		{
+			name:    "a single value",
+			values:  []float64{42},
+			percent: 25,
+			want:    42,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			values := append([]float64(nil), tt.values...)
+			if got := trimmedMean(values, tt.percent); math.Abs(got-tt.want) > 1e-9 {
+				t.Errorf("trimmedMean() = %v, want %v", got, tt.want)
+			}
+			if !reflect.DeepEqual(values, tt.values) {
+				t.Errorf("trimmedMean() sorted the values in place: %v", values)
+			}
+		})
+	}
+}
+
+// stackedMetrics returns the "<graph>/<metric>" of the stacked metrics of the graphs
+func stackedMetrics(graphs map[string]mp.Graphs) []string {
+	var stacked []string
+	for key, g := range graphs {
+		for _, m := range g.Metrics {
+			if m.Stacked {
+				stacked = append(stacked, key+"/"+m.Name)
+			}
+		}
+	}
+	sort.Strings(stacked)
+	return stacked
+}
+
+func TestGraphDefinitionStacked(t *testing.T) {
+	p := newTestPlugin(t, nil, nil)
+	p.ServiceName = "web"
+	p.TargetGroupARN = "arn:aws:elasticloadbalancing:ap-northeast-1:123456789012:targetgroup/web/0123456789abcdef"
+	p.EmitClusterTotals = true
+	p.EmitUtilizationBands = true
+	p.UtilizationBandBoundaries = defaultUtilizationBands
+	p.EmitCapacityProviders = true
+
+	want := []string{
+		"CPUUtilizationBands/CPUUtilizationBand0To25",
+		"CPUUtilizationBands/CPUUtilizationBand25To50",
+		"CPUUtilizationBands/CPUUtilizationBand50To75",
+		"CPUUtilizationBands/CPUUtilizationBand75To",
+		"CapacityProviderInstances.#/Attached",
+		"ClusterTask/ClusterTaskPending",
+		"ClusterTask/ClusterTaskRunning",
+		"Deployment/DeploymentActive",
+		"Deployment/DeploymentPrimary",
+		"TargetGroupHealth/TargetGroupHealthy",
+		"TargetGroupHealth/TargetGroupUnhealthy",
+		"Task/TaskPending",
+		"Task/TaskRunning",
+	}
+	if got := stackedMetrics(p.GraphDefinition()); !reflect.DeepEqual(got, want) {
+		t.Errorf("stacked metrics = %v, want %v", got, want)
+	}
+
+	p.NoStacking = true
+	if got := stackedMetrics(p.GraphDefinition()); len(got) != 0 {
+		t.Errorf("stacked metrics with NoStacking = %v, want none", got)
+	}
+}
+
+func TestFargateGraphs(t *testing.T) {
+	reservations := []string{"CPUReservation", "MemoryReservation", "GPUReservation"}
+	cw := &fakeCloudWatch{points: make(map[string][]point)}
+	for _, m := range append(reservations, "CPUUtilization", "MemoryUtilization") {
+		cw.points[m+" "+metricsTypeAverage] = minutesAgo(40, 50)
+	}
+
+	tests := []struct {
+		name       string
+		launchType string
+		service    bool
+		want       bool
+	}{
+		{name: "ec2 cluster", launchType: launchTypeEC2, want: true},
+		{name: "ec2 service with the cluster reservation", launchType: launchTypeEC2, service: true, want: true},
+		{name: "fargate cluster", launchType: launchTypeFargate},
+		{name: "fargate service with the cluster reservation", launchType: launchTypeFargate, service: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := &fakeECS{services: map[string]*ecs.Service{"web": newService("web", 1, 0, 1)}}
+			p := newTestPlugin(t, cw, e)
+			p.LaunchType = tt.launchType
+			p.Statistics = []string{metricsTypeAverage}
+			p.GPU = true
+			if tt.service {
+				p.ServiceName = "web"
+				p.IncludeClusterReservation = true
+			}
+
+			graphs := p.GraphDefinition()
+			if _, ok := graphs["CPUUtilization"]; !ok {
+				t.Errorf("GraphDefinition() has no CPUUtilization")
+			}
+			stat, err := p.FetchMetrics()
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, m := range reservations {
+				if _, ok := graphs[m]; ok != tt.want {
+					t.Errorf("GraphDefinition() has %s: %v, want %v", m, ok, tt.want)
+				}
+				if _, ok := stat[m+metricsTypeAverage]; ok != tt.want {
+					t.Errorf("FetchMetrics() has %s: %v, want %v", m+metricsTypeAverage, ok, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestQueryDimensions(t *testing.T) {
+	extra := []*cloudwatch.Dimension{{Name: aws.String("Environment"), Value: aws.String("prod")}}
+	tests := []struct {
+		name      string
+		service   string
+		family    string
+		extra     []*cloudwatch.Dimension
+		metric    string
+		namespace string
+		want      []string
+	}{
+		{name: "cluster metric of the cluster", metric: "CPUUtilization", namespace: namespace, want: []string{"ClusterName=test"}},
+		{name: "reservation of the cluster", metric: "CPUReservation", namespace: namespace, want: []string{"ClusterName=test"}},
+		{name: "service metric", service: "web", metric: "CPUUtilization", namespace: namespace, want: []string{"ClusterName=test", "ServiceName=web"}},
+		{name: "memory of the service", service: "web", metric: "MemoryUtilization", namespace: namespace, want: []string{"ClusterName=test", "ServiceName=web"}},
+		// the reservations are published per cluster only
+		{name: "reservation with a service", service: "web", metric: "CPUReservation", namespace: namespace, want: []string{"ClusterName=test"}},
+		{name: "memory reservation with a service", service: "web", metric: "MemoryReservation", namespace: namespace, want: []string{"ClusterName=test"}},
+		{name: "GPU reservation with a service", service: "web", metric: "GPUReservation", namespace: namespace, want: []string{"ClusterName=test"}},
+		{name: "service metric with extras", service: "web", extra: extra, metric: "CPUUtilization", namespace: namespace, want: []string{"ClusterName=test", "ServiceName=web", "Environment=prod"}},
+		{name: "reservation with extras", service: "web", extra: extra, metric: "CPUReservation", namespace: namespace, want: []string{"ClusterName=test", "Environment=prod"}},
+		// Container Insights has no extras of the custom namespace
+		{name: "Container Insights of the service", service: "web", extra: extra, metric: "NetworkRxBytes", namespace: containerInsightsNamespace, want: []string{"ClusterName=test", "ServiceName=web"}},
+		{name: "Container Insights of the family", family: "app", metric: "CpuUtilized", namespace: containerInsightsNamespace, want: []string{"ClusterName=test", "TaskDefinitionFamily=app"}},
+		{name: "reservation with a family", family: "app", metric: "CPUReservation", namespace: namespace, want: []string{"ClusterName=test"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newTestPlugin(t, nil, nil)
+			p.ServiceName = tt.service
+			p.TaskDefinitionFamily = tt.family
+			p.ExtraDimensions = tt.extra
+			q := p.query(metrics{tt.metric, metricsTypeAverage})
+			if q.namespace != tt.namespace {
+				t.Errorf("namespace = %s, want %s", q.namespace, tt.namespace)
+			}
+			var got []string
+			for _, d := range q.dimensions {
+				got = append(got, aws.StringValue(d.Name)+"="+aws.StringValue(d.Value))
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("dimensions = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,138 @@
+package mpawsecs
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+	"github.com/aws/aws-sdk-go/service/ecs"
+	mp "github.com/mackerelio/go-mackerel-plugin"
+)
+
+// managedScalingNamespace is where managed scaling publishes CapacityProviderReservation
+const managedScalingNamespace = "AWS/ECS/ManagedScaling"
+
+// describeCapacityProviders returns the number of container instances registered to the cluster
+// and the Auto Scaling group capacity providers associated with it. The Fargate capacity providers
+// have no instances of their own and are left out.
+func (p ECSPlugin) describeCapacityProviders() (int64, []*ecs.CapacityProvider, error) {
+	out, err := p.ECS.DescribeClustersWithContext(p.context(), &ecs.DescribeClustersInput{
+		Clusters: aws.StringSlice([]string{p.ClusterName}),
+	})
+	if err != nil {
+		return 0, nil, err
+	}
+	if len(out.Clusters) == 0 {
+		return 0, nil, fmt.Errorf("cluster %s not found", p.ClusterName)
+	}
+	cluster := out.Clusters[0]
+	if len(cluster.CapacityProviders) == 0 {
+		return aws.Int64Value(cluster.RegisteredContainerInstancesCount), nil, nil
+	}
+
+	var providers []*ecs.CapacityProvider
+	input := &ecs.DescribeCapacityProvidersInput{
+		CapacityProviders: cluster.CapacityProviders,
+	}
+	for {
+		page, err := p.ECS.DescribeCapacityProvidersWithContext(p.context(), input)
+		if err != nil {
+			return 0, nil, err
+		}
+		for _, f := range page.Failures {
+			log.Printf("failed to describe capacity provider %s: %s", aws.StringValue(f.Arn), aws.StringValue(f.Reason))
+		}
+		for _, cp := range page.CapacityProviders {
+			if cp.AutoScalingGroupProvider != nil {
+				providers = append(providers, cp)
+			}
+		}
+		if page.NextToken == nil {
+			break
+		}
+		input.NextToken = page.NextToken
+	}
+	return aws.Int64Value(cluster.RegisteredContainerInstancesCount), providers, nil
+}
+
+// addCapacityProviders reports the registered container instances of the cluster and the attached
+// instances of each capacity provider into stat, and adds the queries of CapacityProviderReservation
+// of the capacity providers with managed scaling to the batch.
+func (p ECSPlugin) addCapacityProviders(b *batch, stat map[string]float64) {
+	registered, providers, err := p.describeCapacityProviders()
+	if err != nil {
+		log.Printf("failed to describe the capacity providers: %s", err)
+		return
+	}
+	stat["RegisteredContainerInstances"] = float64(registered)
+	if len(providers) == 0 {
+		return
+	}
+
+	instances, err := p.describeContainerInstances()
+	if err != nil {
+		log.Printf("failed to describe the container instances: %s", err)
+	}
+	attached := make(map[string]int)
+	for _, ci := range instances {
+		attached[aws.StringValue(ci.CapacityProviderName)]++
+	}
+
+	for _, cp := range providers {
+		name := aws.StringValue(cp.Name)
+		key := sanitizeMetricKey(name)
+		if err == nil {
+			stat["CapacityProviderInstances."+key+".Attached"] = float64(attached[name])
+		}
+
+		ms := cp.AutoScalingGroupProvider.ManagedScaling
+		if ms == nil || aws.StringValue(ms.Status) != ecs.ManagedScalingStatusEnabled {
+			continue
+		}
+		dimensions := []*cloudwatch.Dimension{
+			{Name: aws.String("ClusterName"), Value: aws.String(p.ClusterName)},
+			{Name: aws.String("CapacityProviderName"), Value: aws.String(name)},
+		}
+		for _, t := range p.statistics() {
+			name, statKey, met := name, "CapacityProviderReservation."+key+"."+t, metrics{"CapacityProviderReservation", t}
+			b.add(query{managedScalingNamespace, dimensions, met}, func(s series, err error) {
+				if err != nil {
+					p.logQueryError(fmt.Sprint(name, " ", met), err)
+					p.markMissing(stat, statKey, err)
+					return
+				}
+				p.setPoint(stat, statKey, s)
+			})
+		}
+	}
+}
+
+func (p ECSPlugin) capacityProviderGraphDefinition() map[string]mp.Graphs {
+	labelPrefix := p.labelPrefix()
+	var reservation []mp.Metrics
+	for _, t := range p.statistics() {
+		reservation = append(reservation, mp.Metrics{Name: t, Label: "%1 " + t})
+	}
+	return map[string]mp.Graphs{
+		"ContainerInstance": {
+			Label: labelPrefix + " Container Instance",
+			Unit:  "integer",
+			Metrics: []mp.Metrics{
+				{Name: "RegisteredContainerInstances", Label: "Registered"},
+			},
+		},
+		"CapacityProviderInstances.#": {
+			Label: labelPrefix + " Capacity Provider Instances",
+			Unit:  "integer",
+			Metrics: []mp.Metrics{
+				{Name: "Attached", Label: "%1", Stacked: !p.NoStacking},
+			},
+		},
+		"CapacityProviderReservation.#": {
+			Label:   labelPrefix + " Capacity Provider Reservation",
+			Unit:    "percentage",
+			Metrics: reservation,
+		},
+	}
+}
@@ -0,0 +1,301 @@
+package mpawsecs
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+)
+
+// GetMetricData accepts up to 500 queries at once
+const getMetricDataLimit = 500
+
+var errNoDatapoints = errors.New("fetched no datapoints")
+
+// query is a statistic of a CloudWatch metric to fetch
+type query struct {
+	namespace  string
+	dimensions []*cloudwatch.Dimension
+	metric     metrics
+}
+
+// series is the datapoints of a query in ascending order of their timestamps
+type series struct {
+	timestamps []time.Time
+	values     []float64
+	// wall time of the request which fetched the series
+	latency time.Duration
+}
+
+func (s series) Len() int           { return len(s.values) }
+func (s series) Less(i, j int) bool { return s.timestamps[i].Before(s.timestamps[j]) }
+func (s series) Swap(i, j int) {
+	s.timestamps[i], s.timestamps[j] = s.timestamps[j], s.timestamps[i]
+	s.values[i], s.values[j] = s.values[j], s.values[i]
+}
+
+// leastRecent returns the index of the least recent datapoint
+func (s series) leastRecent() int {
+	// get a least recently datapoint
+	// because a most recently datapoint is not stable.
+	return 0
+}
+
+// newestUntil returns the index of the most recent datapoint at or before t,
+// or of the least recent one when there is no such datapoint.
+func (s series) newestUntil(t time.Time) int {
+	for i := len(s.timestamps) - 1; i >= 0; i-- {
+		if !s.timestamps[i].After(t) {
+			return i
+		}
+	}
+	return s.leastRecent()
+}
+
+// batch is a set of queries fetched together. The result of each query is passed to its handler.
+type batch struct {
+	queries  []query
+	handlers []func(s series, err error)
+	// wall time of the longest request of the batch
+	latency time.Duration
+}
+
+func (b *batch) add(q query, handle func(s series, err error)) {
+	b.queries = append(b.queries, q)
+	b.handlers = append(b.handlers, handle)
+}
+
+// interleave merges the batches of the clusters or services into one, taking their queries
+// round-robin. The queries of each target are spread over the GetMetricData requests, so that
+// a failed or timed out request loses a few metrics of every target rather than whole targets.
+func interleave(batches []*batch) *batch {
+	merged := &batch{}
+	for i := 0; ; i++ {
+		added := false
+		for _, b := range batches {
+			if i < len(b.queries) {
+				merged.add(b.queries[i], b.handlers[i])
+				added = true
+			}
+		}
+		if !added {
+			return merged
+		}
+	}
+}
+
+// queryWindow returns how far to look back for the datapoints.
+// It spans at least 3 periods so that at least 1 datapoint is fetched.
+func queryWindow(period, lookback time.Duration) time.Duration {
+	if window := 3 * period; window > lookback {
+		return window
+	}
+	return lookback
+}
+
+// cloudWatchRetentions are how long CloudWatch keeps the datapoints of the periods below
+// maxPeriod: the high-resolution ones for 3 hours, and the 1-minute, 5-minute and 1-hour
+// ones for 15, 63 and 455 days. A longer period is aggregated from the coarser datapoints.
+var cloudWatchRetentions = []struct {
+	maxPeriod time.Duration
+	retention time.Duration
+	data      string
+}{
+	{time.Minute, 3 * time.Hour, "high-resolution data (of a period under 60 seconds) is only available for 3 hours"},
+	{5 * time.Minute, 15 * 24 * time.Hour, "1-minute data is only available for 15 days"},
+	{time.Hour, 63 * 24 * time.Hour, "5-minute data is only available for 63 days"},
+	{0, 455 * 24 * time.Hour, "1-hour data is only available for 455 days"},
+}
+
+// checkRetention fails when the query window of the period and the lookback reaches back
+// past the retention of the datapoints of the period, which CloudWatch returns nothing of.
+func checkRetention(period, lookback time.Duration) error {
+	window := queryWindow(period, lookback)
+	for i, r := range cloudWatchRetentions {
+		if r.maxPeriod != 0 && period >= r.maxPeriod {
+			continue
+		}
+		if window <= r.retention {
+			return nil
+		}
+		if i == len(cloudWatchRetentions)-1 {
+			return fmt.Errorf("%s: the query window of %s is longer", r.data, window)
+		}
+		return fmt.Errorf("%s: the query window of %s is longer, use a period of at least %d seconds or a shorter lookback", r.data, window, int(r.maxPeriod/time.Second))
+	}
+	return nil
+}
+
+// fetch runs the queries of the batch in as few GetMetricData requests as possible,
+// which are sent concurrently up to MaxConcurrency.
+// A query without datapoints gets errNoDatapoints, and a failed request fails only its own queries.
+// The queries without datapoints are summarized in a single log line.
+func (p ECSPlugin) fetch(b *batch) {
+	type chunk struct {
+		start, end int
+		results    []series
+		errs       []error
+	}
+	var chunks []*chunk
+	for i := 0; i < len(b.queries); i += getMetricDataLimit {
+		end := i + getMetricDataLimit
+		if end > len(b.queries) {
+			end = len(b.queries)
+		}
+		chunks = append(chunks, &chunk{start: i, end: end})
+	}
+
+	parallel(len(chunks), p.concurrency(len(chunks)), func(i int) {
+		c := chunks[i]
+		start := time.Now()
+		c.results, c.errs = p.getMetricData(b.queries[c.start:c.end])
+		latency := time.Since(start)
+		for j := range c.results {
+			c.results[j].latency = latency
+		}
+	})
+
+	// the handlers write to the stat, so they are called one by one
+	noData := 0
+	for _, c := range chunks {
+		if len(c.results) > 0 && c.results[0].latency > b.latency {
+			b.latency = c.results[0].latency
+		}
+		for j, s := range c.results {
+			if errors.Is(c.errs[j], errNoDatapoints) {
+				noData++
+			}
+			if p.Debug {
+				p.logQuery(b.queries[c.start+j], s, c.errs[j])
+			}
+			b.handlers[c.start+j](s, c.errs[j])
+		}
+	}
+	if noData > 0 {
+		log.Printf("%d of %d queries had no datapoints in the window (-debug lists them)", noData, len(b.queries))
+	}
+}
+
+// querySummary is the summary of a query logged as a JSON line in debug mode
+type querySummary struct {
+	Namespace  string            `json:"namespace"`
+	Metric     string            `json:"metric"`
+	Statistic  string            `json:"statistic"`
+	Dimensions map[string]string `json:"dimensions"`
+	Period     int64             `json:"period"`
+	Datapoints int               `json:"datapoints"`
+	// the timestamp of the datapoint selected to report
+	Timestamp *time.Time `json:"timestamp,omitempty"`
+	LatencyMs float64    `json:"latencyMs"`
+	Error     string     `json:"error,omitempty"`
+}
+
+// logQuery logs the summary of the query and its result in debug mode, which tells wrong
+// dimensions or period (no datapoints at all) from datapoints that have not arrived yet.
+func (p ECSPlugin) logQuery(q query, s series, err error) {
+	summary := querySummary{
+		Namespace:  q.namespace,
+		Metric:     q.metric.Name,
+		Statistic:  q.metric.Type,
+		Dimensions: make(map[string]string, len(q.dimensions)),
+		Period:     int64(p.Period / time.Second),
+		Datapoints: s.Len(),
+		LatencyMs:  float64(s.latency) / float64(time.Millisecond),
+	}
+	for _, d := range q.dimensions {
+		summary.Dimensions[aws.StringValue(d.Name)] = aws.StringValue(d.Value)
+	}
+	if s.Len() > 0 {
+		t := s.timestamps[p.selectIndex(s)]
+		summary.Timestamp = &t
+	}
+	if err != nil {
+		summary.Error = err.Error()
+	}
+	b, err := json.Marshal(summary)
+	if err != nil {
+		return
+	}
+	p.debugf("query: %s", b)
+}
+
+// logQueryError logs the error of a query. No datapoints in the window is no error
+// (e.g. of an idle service) and is logged only in debug mode. The queries aborted by
+// the cancellation of the collection are not logged, which FetchMetrics logs at once.
+func (p ECSPlugin) logQueryError(name string, err error) {
+	if p.context().Err() != nil {
+		return
+	}
+	if errors.Is(err, errNoDatapoints) {
+		p.debugf("%s: %s", name, err)
+		return
+	}
+	log.Printf("%s: %s", name, err)
+}
+
+func (p ECSPlugin) getMetricData(queries []query) ([]series, []error) {
+	results := make([]series, len(queries))
+	errs := make([]error, len(queries))
+	if p.MetricStreamFile != "" {
+		for i, q := range queries {
+			results[i], errs[i] = streamSeries(p.metricStream, q, queryWindow(p.Period, p.Lookback))
+		}
+		return results, errs
+	}
+
+	dataQueries := make([]*cloudwatch.MetricDataQuery, len(queries))
+	index := make(map[string]int, len(queries))
+	for i, q := range queries {
+		id := fmt.Sprintf("q%d", i)
+		index[id] = i
+		dataQueries[i] = &cloudwatch.MetricDataQuery{
+			Id: aws.String(id),
+			MetricStat: &cloudwatch.MetricStat{
+				Metric: &cloudwatch.Metric{
+					Namespace:  aws.String(q.namespace),
+					MetricName: aws.String(q.metric.Name),
+					Dimensions: q.dimensions,
+				},
+				Period: aws.Int64(int64(p.Period / time.Second)),
+				Stat:   aws.String(q.metric.Type),
+			},
+			ReturnData: aws.Bool(true),
+		}
+	}
+
+	now := time.Now()
+	input := &cloudwatch.GetMetricDataInput{
+		MetricDataQueries: dataQueries,
+		StartTime:         aws.Time(now.Add(-queryWindow(p.Period, p.Lookback))),
+		EndTime:           aws.Time(now),
+		ScanBy:            aws.String(cloudwatch.ScanByTimestampAscending),
+	}
+	err := p.CloudWatch.GetMetricDataPagesWithContext(p.context(), input, func(page *cloudwatch.GetMetricDataOutput, lastPage bool) bool {
+		for _, r := range page.MetricDataResults {
+			i, ok := index[aws.StringValue(r.Id)]
+			if !ok {
+				continue
+			}
+			if aws.StringValue(r.StatusCode) == cloudwatch.StatusCodeInternalError {
+				errs[i] = fmt.Errorf("%s: %v", aws.StringValue(r.StatusCode), r.Messages)
+			}
+			results[i].timestamps = append(results[i].timestamps, aws.TimeValueSlice(r.Timestamps)...)
+			results[i].values = append(results[i].values, aws.Float64ValueSlice(r.Values)...)
+		}
+		return true
+	})
+	for i := range results {
+		if err != nil {
+			errs[i] = err
+		} else if errs[i] == nil && results[i].Len() == 0 {
+			errs[i] = errNoDatapoints
+		}
+		sort.Sort(results[i])
+	}
+	return results, errs
+}
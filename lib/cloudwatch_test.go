@@ -0,0 +1,271 @@
+package mpawsecs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+	"github.com/aws/aws-sdk-go/service/ecs"
+)
+
+func TestSelectIndex(t *testing.T) {
+	now := time.Now()
+	s := series{
+		timestamps: []time.Time{now.Add(-4 * time.Minute), now.Add(-3 * time.Minute), now.Add(-2 * time.Minute), now.Add(-time.Minute)},
+		values:     []float64{1, 2, 3, 4},
+	}
+
+	tests := []struct {
+		name         string
+		datapointLag time.Duration
+		want         int
+	}{
+		{name: "least recent", want: 0},
+		{name: "newest older than the lag", datapointLag: 90 * time.Second, want: 2},
+		{name: "lag of the newest", datapointLag: 30 * time.Second, want: 3},
+		{name: "no datapoint older than the lag", datapointLag: 10 * time.Minute, want: 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := ECSPlugin{DatapointLag: tt.datapointLag}
+			if got := p.selectIndex(s); got != tt.want {
+				t.Errorf("selectIndex() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGetMetricDataStatistics(t *testing.T) {
+	cw := &fakeCloudWatch{points: map[string][]point{
+		"CPUUtilization Average":     minutesAgo(30, 35, 40),
+		"CPUUtilization Minimum":     minutesAgo(10, 15, 20),
+		"CPUUtilization Maximum":     minutesAgo(70, 75, 80),
+		"CPUUtilization SampleCount": minutesAgo(4, 5, 6),
+	}}
+
+	tests := []struct {
+		statistic string
+		want      float64
+		wantErr   error
+	}{
+		{statistic: metricsTypeAverage, want: 30},
+		{statistic: metricsTypeMinimum, want: 10},
+		{statistic: metricsTypeMaximum, want: 70},
+		{statistic: metricsTypeSampleCount, want: 4},
+		// no datapoints in the window
+		{statistic: metricsTypeSum, wantErr: errNoDatapoints},
+	}
+	for _, tt := range tests {
+		t.Run(tt.statistic, func(t *testing.T) {
+			p := newTestPlugin(t, cw, nil)
+			met := metrics{"CPUUtilization", tt.statistic}
+			results, errs := p.getMetricData([]query{p.query(met)})
+			if !errors.Is(errs[0], tt.wantErr) {
+				t.Fatalf("err = %v, want %v", errs[0], tt.wantErr)
+			}
+			if tt.wantErr != nil {
+				if results[0].Len() != 0 {
+					t.Errorf("values = %v, want none", results[0].values)
+				}
+				return
+			}
+			if got := p.lastPoint(results[0], met); got != tt.want {
+				t.Errorf("lastPoint() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAddLastPointWithoutDatapoints(t *testing.T) {
+	p := newTestPlugin(t, &fakeCloudWatch{}, nil)
+	stat := make(map[string]float64)
+	b := &batch{}
+	p.addLastPoint(b, stat, "CPUUtilizationAverage", metrics{"CPUUtilization", metricsTypeAverage})
+	p.fetch(b)
+	if v, ok := stat["CPUUtilizationAverage"]; ok {
+		t.Errorf("CPUUtilizationAverage = %v, want none", v)
+	}
+}
+
+// windowCloudWatch records the time range of the last GetMetricData request
+type windowCloudWatch struct {
+	fakeCloudWatch
+	window time.Duration
+}
+
+func (c *windowCloudWatch) GetMetricDataPagesWithContext(ctx aws.Context, input *cloudwatch.GetMetricDataInput, fn func(*cloudwatch.GetMetricDataOutput, bool) bool, opts ...request.Option) error {
+	c.window = aws.TimeValue(input.EndTime).Sub(aws.TimeValue(input.StartTime))
+	return c.fakeCloudWatch.GetMetricDataPagesWithContext(ctx, input, fn, opts...)
+}
+
+func TestQueryWindow(t *testing.T) {
+	tests := []struct {
+		name     string
+		period   time.Duration
+		lookback time.Duration
+		want     time.Duration
+	}{
+		{name: "defaults", period: time.Minute, lookback: 5 * time.Minute, want: 5 * time.Minute},
+		{name: "lookback of 3 periods", period: time.Minute, lookback: 3 * time.Minute, want: 3 * time.Minute},
+		{name: "lookback shorter than 3 periods", period: time.Minute, lookback: time.Minute, want: 3 * time.Minute},
+		{name: "long period", period: 5 * time.Minute, lookback: 5 * time.Minute, want: 15 * time.Minute},
+		{name: "long lookback", period: 5 * time.Minute, lookback: time.Hour, want: time.Hour},
+		{name: "high resolution", period: 10 * time.Second, lookback: 20 * time.Second, want: 30 * time.Second},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := queryWindow(tt.period, tt.lookback); got != tt.want {
+				t.Errorf("queryWindow(%s, %s) = %s, want %s", tt.period, tt.lookback, got, tt.want)
+			}
+
+			cw := &windowCloudWatch{}
+			p := newTestPlugin(t, nil, nil)
+			p.CloudWatch = cw
+			p.Period = tt.period
+			p.Lookback = tt.lookback
+			p.getMetricData([]query{p.query(metrics{"CPUUtilization", metricsTypeAverage})})
+			if cw.window != tt.want {
+				t.Errorf("GetMetricData requested %s, want %s", cw.window, tt.want)
+			}
+		})
+	}
+}
+
+func TestCheckRetention(t *testing.T) {
+	day := 24 * time.Hour
+	tests := []struct {
+		name     string
+		period   time.Duration
+		lookback time.Duration
+		wantErr  string
+	}{
+		{name: "defaults", period: defaultPeriod, lookback: defaultLookback},
+		{name: "high resolution within 3 hours", period: 10 * time.Second, lookback: 3 * time.Hour},
+		{name: "high resolution past 3 hours", period: 10 * time.Second, lookback: 3*time.Hour + time.Minute, wantErr: "high-resolution data"},
+		{name: "1-minute within 15 days", period: time.Minute, lookback: 15 * day},
+		{name: "1-minute past 15 days", period: time.Minute, lookback: 20 * day, wantErr: "1-minute data is only available for 15 days"},
+		{name: "2-minute past 15 days", period: 2 * time.Minute, lookback: 15*day + time.Hour, wantErr: "1-minute data is only available for 15 days"},
+		{name: "5-minute past 15 days", period: 5 * time.Minute, lookback: 20 * day},
+		{name: "5-minute past 63 days", period: 5 * time.Minute, lookback: 64 * day, wantErr: "5-minute data is only available for 63 days"},
+		{name: "1-hour past 63 days", period: time.Hour, lookback: 64 * day},
+		{name: "1-hour past 455 days", period: time.Hour, lookback: 456 * day, wantErr: "1-hour data is only available for 455 days"},
+		// the window spans 3 periods even with a shorter lookback
+		{name: "window of 3 periods", period: 200 * day, lookback: time.Hour, wantErr: "1-hour data"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkRetention(tt.period, tt.lookback)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("checkRetention() = %v, want nil", err)
+				}
+				return
+			}
+			if err == nil || !strings.HasPrefix(err.Error(), tt.wantErr) {
+				t.Errorf("checkRetention() = %v, want %s", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestPrepareRetention(t *testing.T) {
+	p := newTestPlugin(t, nil, nil)
+	p.Lookback = 20 * 24 * time.Hour
+	err := p.prepare()
+	if err == nil || !strings.Contains(err.Error(), "use a period of at least 300 seconds") {
+		t.Errorf("prepare() = %v, want the error of the retention", err)
+	}
+}
+
+func TestInterleave(t *testing.T) {
+	var called []string
+	newBatch := func(target string, n int) *batch {
+		b := &batch{}
+		for i := 0; i < n; i++ {
+			name := fmt.Sprintf("%s%d", target, i)
+			b.add(query{metric: metrics{name, metricsTypeAverage}}, func(series, error) {
+				called = append(called, name)
+			})
+		}
+		return b
+	}
+
+	b := interleave([]*batch{newBatch("web", 3), newBatch("worker", 1), newBatch("batch", 2)})
+	want := []string{"web0", "worker0", "batch0", "web1", "batch1", "web2"}
+	var got []string
+	for i, q := range b.queries {
+		got = append(got, q.metric.Name)
+		b.handlers[i](series{}, nil)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("queries = %v, want %v", got, want)
+	}
+	// each handler stays with its query
+	if !reflect.DeepEqual(called, want) {
+		t.Errorf("handlers = %v, want %v", called, want)
+	}
+}
+
+// failingCloudWatch fails the fail-th GetMetricData request
+type failingCloudWatch struct {
+	fakeCloudWatch
+	fail  int
+	calls int
+}
+
+func (c *failingCloudWatch) GetMetricDataPagesWithContext(ctx aws.Context, input *cloudwatch.GetMetricDataInput, fn func(*cloudwatch.GetMetricDataOutput, bool) bool, opts ...request.Option) error {
+	c.calls++
+	if c.calls == c.fail {
+		return context.DeadlineExceeded
+	}
+	return c.fakeCloudWatch.GetMetricDataPagesWithContext(ctx, input, fn, opts...)
+}
+
+func TestFetchMetricsFailedChunkOfServices(t *testing.T) {
+	// 100 services of 6 queries are sent in 2 requests of 500 and 100 queries
+	cw := &failingCloudWatch{fakeCloudWatch: fakeCloudWatch{points: make(map[string][]point)}, fail: 2}
+	services := make(map[string]*ecs.Service)
+	var names []string
+	for i := 0; i < 100; i++ {
+		name := fmt.Sprintf("service%02d", i)
+		names = append(names, name)
+		services[name] = newService(name, 1, 0, 1)
+		for _, m := range []string{"CPUUtilization", "MemoryUtilization"} {
+			for _, stat := range defaultStatistics {
+				cw.points[name+" "+m+" "+stat] = minutesAgo(10, 10)
+			}
+		}
+	}
+	p := newTestPlugin(t, nil, &fakeECS{services: services})
+	p.CloudWatch = cw
+	p.ServiceName = strings.Join(names, ",")
+	// the requests are sent one by one, so the second one is the last chunk
+	p.MaxConcurrency = 1
+
+	stat, err := p.FetchMetrics()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cw.calls != 2 {
+		t.Fatalf("%d GetMetricData requests, want 2", cw.calls)
+	}
+	for _, name := range names {
+		n := 0
+		for key := range stat {
+			if strings.HasPrefix(key, name+".CPUUtilization.") || strings.HasPrefix(key, name+".MemoryUtilization.") {
+				n++
+			}
+		}
+		// the failed request lost a single metric of every service
+		if n != 5 {
+			t.Errorf("%s has %d of its 6 metrics, want 5", name, n)
+		}
+	}
+}
@@ -0,0 +1,137 @@
+package mpawsecs
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	mp "github.com/mackerelio/go-mackerel-plugin"
+)
+
+// targetsConfig is the file of -config. Each target is the flags to collect it with,
+// such as {"region": "ap-northeast-1", "cluster-name": "prod", "metric-key-prefix": "ECSProd"},
+// which override the ones of the command line.
+type targetsConfig struct {
+	Targets []map[string]interface{} `json:"targets"`
+}
+
+// loadTargets reads the flags of the targets from the config file
+func loadTargets(path string) ([]map[string]string, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var config targetsConfig
+	if err := json.Unmarshal(b, &config); err != nil {
+		return nil, fmt.Errorf("invalid config %s: %s", path, err)
+	}
+	if len(config.Targets) == 0 {
+		return nil, fmt.Errorf("no targets in config %s", path)
+	}
+
+	targets := make([]map[string]string, len(config.Targets))
+	for i, t := range config.Targets {
+		targets[i] = make(map[string]string, len(t))
+		for name, v := range t {
+			if flag.Lookup(name) == nil || name == "config" {
+				return nil, fmt.Errorf("target %d of config %s: unknown flag %q", i, path, name)
+			}
+			// numbers and booleans are given as they are written on the command line
+			targets[i][name] = fmt.Sprint(v)
+		}
+	}
+	return targets, nil
+}
+
+// configuredPlugins builds the plugin of each target of the config file with newPlugin,
+// after setting the flags of the target over the ones of the command line.
+func configuredPlugins(path string, newPlugin func() ECSPlugin) ([]ECSPlugin, error) {
+	targets, err := loadTargets(path)
+	if err != nil {
+		return nil, err
+	}
+
+	base := make(map[string]string)
+	flag.VisitAll(func(f *flag.Flag) {
+		base[f.Name] = f.Value.String()
+	})
+
+	var plugins []ECSPlugin
+	prefixes := make(map[string]int)
+	for i, t := range targets {
+		for name, v := range base {
+			setFlag(name, v)
+		}
+		for name, v := range t {
+			if err := setFlag(name, v); err != nil {
+				return nil, fmt.Errorf("target %d of config %s: invalid %s: %s", i, path, name, err)
+			}
+		}
+		plugin := newPlugin()
+		// the metric keys and the state files are told apart by the prefix
+		if j, ok := prefixes[plugin.MetricKeyPrefix()]; ok {
+			return nil, fmt.Errorf("targets %d and %d of config %s have the same metric-key-prefix %q", j, i, path, plugin.MetricKeyPrefix())
+		}
+		prefixes[plugin.MetricKeyPrefix()] = i
+		plugins = append(plugins, plugin)
+	}
+	return plugins, nil
+}
+
+// setFlag sets the flag to v, replacing the values of a repeatable flag instead of appending v
+func setFlag(name, v string) error {
+	if r, ok := flag.Lookup(name).Value.(interface{ reset() }); ok {
+		r.reset()
+	}
+	return flag.Set(name, v)
+}
+
+// multiPlugin collects the targets of -config in a single run
+type multiPlugin []ECSPlugin
+
+// GraphDefinition returns the graphs of all targets keyed with their prefixes
+func (m multiPlugin) GraphDefinition() map[string]mp.Graphs {
+	graphs := make(map[string]mp.Graphs)
+	for _, p := range m {
+		for key, g := range p.GraphDefinition() {
+			graphs[p.MetricKeyPrefix()+"."+key] = g
+		}
+	}
+	return graphs
+}
+
+// FetchMetrics returns the metrics of all targets keyed by their full metric keys
+func (m multiPlugin) FetchMetrics() (map[string]float64, error) {
+	values := make(map[string]float64)
+	for _, p := range m {
+		stat, err := p.FetchMetrics()
+		if err != nil {
+			return nil, err
+		}
+		for key, v := range p.metricValues(stat) {
+			values[key] = v
+		}
+	}
+	return values, nil
+}
+
+// run outputs the graph definitions of all targets, or the values of the targets
+// collected concurrently and printed in the order of the config file.
+func (m multiPlugin) run() {
+	if os.Getenv("MACKEREL_AGENT_PLUGIN_META") != "" {
+		helper := mp.NewMackerelPlugin(m)
+		helper.OutputDefinitions()
+		return
+	}
+
+	outputs := make([]bytes.Buffer, len(m))
+	parallel(len(m), len(m), func(i int) {
+		m[i].outputValues(&outputs[i])
+	})
+	for i := range outputs {
+		io.Copy(os.Stdout, &outputs[i])
+	}
+}
@@ -0,0 +1,227 @@
+package mpawsecs
+
+import (
+	"fmt"
+	"log"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+	mp "github.com/mackerelio/go-mackerel-plugin"
+)
+
+const containerInsightsNamespace = "ECS/ContainerInsights"
+
+// containerInsightsInterval is how often Container Insights collects the metrics of a task
+const containerInsightsInterval = time.Minute
+
+// container-level metrics of Container Insights with enhanced observability
+var containerMetrics = map[string]string{
+	"ContainerCPUUtilization":    "ContainerCpuUtilization",
+	"ContainerMemoryUtilization": "ContainerMemoryUtilization",
+}
+
+var metricKeySanitizeReg = regexp.MustCompile(`[^-a-zA-Z0-9_]`)
+
+// sanitizeMetricKey makes s usable as a segment of a metric key
+func sanitizeMetricKey(s string) string {
+	return metricKeySanitizeReg.ReplaceAllString(s, "_")
+}
+
+// listContainers returns the container names which publish container-level metrics for the service.
+func (p ECSPlugin) listContainers() ([]string, error) {
+	if p.MetricStreamFile != "" {
+		return streamContainers(p.metricStream, p.ClusterName, p.ServiceName), nil
+	}
+
+	var containers []string
+	input := &cloudwatch.ListMetricsInput{
+		Namespace:  aws.String(containerInsightsNamespace),
+		MetricName: aws.String(containerMetrics["ContainerCPUUtilization"]),
+		Dimensions: []*cloudwatch.DimensionFilter{
+			{Name: aws.String("ClusterName"), Value: aws.String(p.ClusterName)},
+			{Name: aws.String("ServiceName"), Value: aws.String(p.ServiceName)},
+			{Name: aws.String("ContainerName")},
+		},
+		RecentlyActive: aws.String(cloudwatch.RecentlyActivePt3h),
+	}
+	err := p.CloudWatch.ListMetricsPagesWithContext(p.context(), input, func(page *cloudwatch.ListMetricsOutput, lastPage bool) bool {
+		for _, m := range page.Metrics {
+			// skip the task-scoped metrics which have the TaskId dimension too
+			if len(m.Dimensions) != 3 {
+				continue
+			}
+			for _, d := range m.Dimensions {
+				if *d.Name == "ContainerName" {
+					containers = append(containers, *d.Value)
+				}
+			}
+		}
+		return true
+	})
+	return containers, err
+}
+
+func (p ECSPlugin) addContainerMetrics(b *batch, stat map[string]float64) {
+	if p.ServiceName == "" {
+		log.Printf("container-level metrics require -service-name, skipped")
+		return
+	}
+	containers, err := p.listContainers()
+	if err != nil {
+		log.Printf("failed to list containers: %s", err)
+		return
+	}
+	if len(containers) == 0 {
+		log.Printf("no container-level metrics found in %s, Container Insights with enhanced observability is required", containerInsightsNamespace)
+		return
+	}
+
+	for _, container := range containers {
+		dimensions := append(p.dimensions(), &cloudwatch.Dimension{
+			Name:  aws.String("ContainerName"),
+			Value: aws.String(container),
+		})
+		for key, name := range containerMetrics {
+			for _, t := range p.statistics() {
+				container, statKey, met := container, key+"."+sanitizeMetricKey(container)+"."+t, metrics{name, t}
+				b.add(query{containerInsightsNamespace, dimensions, met}, func(s series, err error) {
+					if err != nil {
+						p.logQueryError(fmt.Sprint(container, " ", met), err)
+						p.markMissing(stat, statKey, err)
+						return
+					}
+					p.setPoint(stat, statKey, s)
+				})
+			}
+		}
+	}
+}
+
+// containerInsight is a metric of Container Insights emitted by -container-insights
+type containerInsight struct {
+	name string
+	unit string
+	// also emit the Sum statistic, the total over the tasks
+	sum bool
+	// published only per service
+	serviceOnly bool
+	// published per task, so the percentiles of ExtendedStatistics over the tasks are emitted too
+	percentiles bool
+	// multiplied to convert into the unit
+	scale float64
+	// the bytes per collection interval, emitted per second
+	rate bool
+}
+
+var containerInsights = []containerInsight{
+	{name: "NetworkRxBytes", unit: "bytes/sec", sum: true},
+	{name: "NetworkTxBytes", unit: "bytes/sec", sum: true},
+	{name: "StorageReadBytes", unit: "bytes/sec", sum: true, rate: true},
+	{name: "StorageWriteBytes", unit: "bytes/sec", sum: true, rate: true},
+	{name: "EphemeralStorageUtilized", unit: "float"},
+	{name: "EphemeralStorageReserved", unit: "float"},
+	{name: "RunningTaskCount", unit: "integer", serviceOnly: true},
+	{name: "PendingTaskCount", unit: "integer", serviceOnly: true},
+	{name: "DesiredTaskCount", unit: "integer", serviceOnly: true},
+	{name: "TaskCpuUtilization", unit: "percentage", serviceOnly: true, percentiles: true},
+	{name: "TaskMemoryUtilization", unit: "percentage", serviceOnly: true, percentiles: true},
+}
+
+// fargateInsights are the metrics of Container Insights emitted for Fargate clusters
+// (-launch-type=fargate) even without -container-insights
+var fargateInsights = map[string]bool{
+	"EphemeralStorageUtilized": true,
+	"EphemeralStorageReserved": true,
+	"NetworkRxBytes":           true,
+	"NetworkTxBytes":           true,
+}
+
+// taskFamilyInsights are the metrics of Container Insights emitted by -task-definition-family
+var taskFamilyInsights = []containerInsight{
+	{name: "CpuUtilized", unit: "float", percentiles: true},
+	{name: "CpuReserved", unit: "float"},
+	{name: "MemoryUtilized", unit: "bytes", scale: 1024 * 1024, percentiles: true},
+	{name: "MemoryReserved", unit: "bytes", scale: 1024 * 1024},
+}
+
+// containerInsightsGraphDefinition returns the graphs of the metrics which Container Insights publishes
+// per cluster or service
+func (p ECSPlugin) containerInsightsGraphDefinition() map[string]mp.Graphs {
+	if !p.ContainerInsights && p.LaunchType == launchTypeFargate {
+		var insights []containerInsight
+		for _, m := range containerInsights {
+			if fargateInsights[m.name] {
+				insights = append(insights, m)
+			}
+		}
+		return p.containerInsightGraphs(insights)
+	}
+	return p.containerInsightGraphs(containerInsights)
+}
+
+func (p ECSPlugin) containerInsightGraphs(insights []containerInsight) map[string]mp.Graphs {
+	labelPrefix := p.labelPrefix()
+	graphs := make(map[string]mp.Graphs)
+	for _, m := range insights {
+		if m.serviceOnly && p.ServiceName == "" {
+			continue
+		}
+		metrics := p.statisticMetrics(m.name, m.scale)
+		if m.sum && !p.hasStatistic(metricsTypeSum) {
+			metrics = append(metrics, mp.Metrics{Name: m.name + metricsTypeSum, Label: metricsTypeSum, Scale: m.scale})
+		}
+		if m.percentiles {
+			for _, t := range p.ExtendedStatistics {
+				metrics = append(metrics, mp.Metrics{Name: m.name + statisticKey(t), Label: t, Scale: m.scale})
+			}
+		}
+		if m.rate {
+			for i := range metrics {
+				metrics[i].Scale = p.rateScale(strings.TrimPrefix(metrics[i].Name, m.name))
+			}
+		}
+		graphs[m.name] = mp.Graphs{
+			Label:   labelPrefix + " " + m.name,
+			Unit:    m.unit,
+			Metrics: metrics,
+		}
+	}
+	return graphs
+}
+
+// rateScale returns the scale of the statistic t of the bytes per collection interval into bytes/sec
+func (p ECSPlugin) rateScale(t string) float64 {
+	switch t {
+	case metricsTypeSum:
+		// the bytes of all the tasks over the period
+		period := p.Period
+		if period == 0 {
+			period = defaultPeriod
+		}
+		return 1 / period.Seconds()
+	case metricsTypeSampleCount:
+		return 0
+	}
+	// the bytes of a task over an interval
+	return 1 / containerInsightsInterval.Seconds()
+}
+
+func (p ECSPlugin) containerGraphDefinition() map[string]mp.Graphs {
+	labelPrefix := p.labelPrefix()
+	graphs := make(map[string]mp.Graphs)
+	var metrics []mp.Metrics
+	for _, t := range p.statistics() {
+		metrics = append(metrics, mp.Metrics{Name: t, Label: "%1 " + t})
+	}
+	for key := range containerMetrics {
+		graphs[key+".#"] = mp.Graphs{
+			Label:   labelPrefix + " " + key,
+			Unit:    "percentage",
+			Metrics: metrics,
+		}
+	}
+	return graphs
+}
@@ -0,0 +1,90 @@
+package mpawsecs
+
+import (
+	"log"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ecs"
+	mp "github.com/mackerelio/go-mackerel-plugin"
+)
+
+// resourceValue returns the integer value of the named resource (CPU in CPU units or MEMORY in MiB)
+func resourceValue(resources []*ecs.Resource, name string) float64 {
+	for _, r := range resources {
+		if aws.StringValue(r.Name) == name {
+			return float64(aws.Int64Value(r.IntegerValue))
+		}
+	}
+	return 0
+}
+
+// fetchContainerInstances reports the registered and remaining CPU and memory of each container
+// instance of the cluster, keyed by its EC2 instance ID, and their totals into stat.
+func (p ECSPlugin) fetchContainerInstances(stat map[string]float64) {
+	instances, err := p.describeContainerInstances()
+	if err != nil {
+		log.Printf("failed to describe the container instances: %s", err)
+		return
+	}
+
+	var totals [4]float64
+	for _, ci := range instances {
+		values := [4]float64{
+			resourceValue(ci.RegisteredResources, "CPU"),
+			resourceValue(ci.RemainingResources, "CPU"),
+			resourceValue(ci.RegisteredResources, "MEMORY"),
+			resourceValue(ci.RemainingResources, "MEMORY"),
+		}
+		key := sanitizeMetricKey(aws.StringValue(ci.Ec2InstanceId))
+		stat["InstanceCPU."+key+".Registered"] = values[0]
+		stat["InstanceCPU."+key+".Remaining"] = values[1]
+		stat["InstanceMemory."+key+".Registered"] = values[2]
+		stat["InstanceMemory."+key+".Remaining"] = values[3]
+		for i, v := range values {
+			totals[i] += v
+		}
+	}
+	stat["ClusterCPURegistered"] = totals[0]
+	stat["ClusterCPURemaining"] = totals[1]
+	stat["ClusterMemoryRegistered"] = totals[2]
+	stat["ClusterMemoryRemaining"] = totals[3]
+}
+
+func (p ECSPlugin) containerInstanceGraphDefinition() map[string]mp.Graphs {
+	labelPrefix := p.labelPrefix()
+	mib := float64(1024 * 1024)
+	return map[string]mp.Graphs{
+		"ClusterCPU": {
+			Label: labelPrefix + " Cluster CPU",
+			Unit:  "integer",
+			Metrics: []mp.Metrics{
+				{Name: "ClusterCPURegistered", Label: "Registered"},
+				{Name: "ClusterCPURemaining", Label: "Remaining"},
+			},
+		},
+		"ClusterMemory": {
+			Label: labelPrefix + " Cluster Memory",
+			Unit:  "bytes",
+			Metrics: []mp.Metrics{
+				{Name: "ClusterMemoryRegistered", Label: "Registered", Scale: mib},
+				{Name: "ClusterMemoryRemaining", Label: "Remaining", Scale: mib},
+			},
+		},
+		"InstanceCPU.#": {
+			Label: labelPrefix + " Instance CPU",
+			Unit:  "integer",
+			Metrics: []mp.Metrics{
+				{Name: "Registered", Label: "%1 Registered"},
+				{Name: "Remaining", Label: "%1 Remaining"},
+			},
+		},
+		"InstanceMemory.#": {
+			Label: labelPrefix + " Instance Memory",
+			Unit:  "bytes",
+			Metrics: []mp.Metrics{
+				{Name: "Registered", Label: "%1 Registered", Scale: mib},
+				{Name: "Remaining", Label: "%1 Remaining", Scale: mib},
+			},
+		},
+	}
+}
@@ -0,0 +1,323 @@
+package mpawsecs
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ecs"
+)
+
+// DescribeServices accepts up to 10 services at once
+const describeServicesLimit = 10
+
+// serviceCache is the result of listServices cached in a state file for DiscoveryCacheTTL
+type serviceCache struct {
+	Cluster   string    `json:"cluster"`
+	FetchedAt time.Time `json:"fetchedAt"`
+	ARNs      []string  `json:"arns"`
+}
+
+// listServices returns the ARNs of all services in the cluster. With DiscoveryCacheTTL
+// they are listed at most once per TTL, as the plugin runs every minute.
+func (p ECSPlugin) listServices() ([]string, error) {
+	if p.DiscoveryCacheTTL <= 0 {
+		return p.listServicesUncached()
+	}
+
+	path := p.stateFile("services")
+	var cache serviceCache
+	if err := loadState(path, &cache); err != nil {
+		log.Printf("failed to load the cached services (ignore): %s", err)
+	}
+	if cache.Cluster == p.ClusterName && time.Since(cache.FetchedAt) < p.DiscoveryCacheTTL {
+		p.debugf("services cached at %s", cache.FetchedAt)
+		return cache.ARNs, nil
+	}
+
+	arns, err := p.listServicesUncached()
+	if err != nil {
+		return nil, err
+	}
+	cache = serviceCache{Cluster: p.ClusterName, FetchedAt: time.Now(), ARNs: arns}
+	if err := saveState(path, cache); err != nil {
+		log.Printf("failed to save the cached services: %s", err)
+	}
+	return arns, nil
+}
+
+func (p ECSPlugin) listServicesUncached() ([]string, error) {
+	var arns []string
+	input := &ecs.ListServicesInput{
+		Cluster: aws.String(p.ClusterName),
+	}
+	err := p.ECS.ListServicesPagesWithContext(p.context(), input, func(page *ecs.ListServicesOutput, lastPage bool) bool {
+		arns = append(arns, aws.StringValueSlice(page.ServiceArns)...)
+		return true
+	})
+	if err != nil || (len(p.FilterTags) == 0 && len(p.ExcludeTags) == 0) {
+		return arns, err
+	}
+	return p.filterByTags(arns)
+}
+
+// filterByTags returns the resources which have all FilterTags and none of ExcludeTags.
+// The tags of each resource are listed concurrently up to MaxConcurrency.
+func (p ECSPlugin) filterByTags(arns []string) ([]string, error) {
+	matched := make([]bool, len(arns))
+	errs := make([]error, len(arns))
+	parallel(len(arns), p.concurrency(len(arns)), func(i int) {
+		out, err := p.ECS.ListTagsForResourceWithContext(p.context(), &ecs.ListTagsForResourceInput{
+			ResourceArn: aws.String(arns[i]),
+		})
+		if err != nil {
+			errs[i] = fmt.Errorf("failed to list the tags of %s: %w", arns[i], err)
+			return
+		}
+		tags := make(map[string]string, len(out.Tags))
+		for _, t := range out.Tags {
+			tags[aws.StringValue(t.Key)] = aws.StringValue(t.Value)
+		}
+		matched[i] = matchTags(tags, p.FilterTags, p.ExcludeTags)
+	})
+
+	var filtered []string
+	for i, arn := range arns {
+		if errs[i] != nil {
+			return nil, errs[i]
+		}
+		if matched[i] {
+			filtered = append(filtered, arn)
+		}
+	}
+	p.debugf("%d of %d resources matched the tags", len(filtered), len(arns))
+	return filtered, nil
+}
+
+// matchTags reports whether tags have all of include and none of exclude
+func matchTags(tags, include, exclude map[string]string) bool {
+	for k, v := range include {
+		if tv, ok := tags[k]; !ok || tv != v {
+			return false
+		}
+	}
+	for k, v := range exclude {
+		if tv, ok := tags[k]; ok && tv == v {
+			return false
+		}
+	}
+	return true
+}
+
+// parseTags parses the Key=Value tags of -filter-tag and -exclude-tag
+func parseTags(list []string) (map[string]string, error) {
+	tags := make(map[string]string)
+	for _, t := range list {
+		k, v, ok := strings.Cut(t, "=")
+		if !ok || k == "" {
+			return nil, fmt.Errorf("invalid tag %q: expected Key=Value", t)
+		}
+		if _, dup := tags[k]; dup {
+			return nil, fmt.Errorf("duplicate tag %s", k)
+		}
+		tags[k] = v
+	}
+	return tags, nil
+}
+
+// parseSelector parses the comma separated terms of -select into the tags to include
+// and exclude. A term is tag:Key=Value (must match) or tag:Key!=Value (must not match),
+// which are what -filter-tag and -exclude-tag select by.
+func parseSelector(s string) (include, exclude map[string]string, err error) {
+	include, exclude = make(map[string]string), make(map[string]string)
+	for _, term := range strings.Split(s, ",") {
+		term = strings.TrimSpace(term)
+		if !strings.HasPrefix(term, "tag:") {
+			return nil, nil, fmt.Errorf("unsupported selector %q: expected tag:Key=Value or tag:Key!=Value", term)
+		}
+		tag := strings.TrimPrefix(term, "tag:")
+		tags := include
+		k, v, ok := strings.Cut(tag, "!=")
+		if ok {
+			tags = exclude
+		} else if k, v, ok = strings.Cut(tag, "="); !ok {
+			return nil, nil, fmt.Errorf("unsupported selector %q: expected tag:Key=Value or tag:Key!=Value", term)
+		}
+		if k == "" {
+			return nil, nil, fmt.Errorf("invalid selector %q: empty tag key", term)
+		}
+		if _, dup := tags[k]; dup {
+			return nil, nil, fmt.Errorf("duplicate tag %s of selector", k)
+		}
+		tags[k] = v
+	}
+	return include, exclude, nil
+}
+
+// mergeTags adds the tags of the selector to the ones of -filter-tag or -exclude-tag
+func mergeTags(tags, selected map[string]string) error {
+	for k, v := range selected {
+		if tv, dup := tags[k]; dup && tv != v {
+			return fmt.Errorf("tag %s of select conflicts with %s=%s", k, k, tv)
+		}
+		tags[k] = v
+	}
+	return nil
+}
+
+// listServiceNames returns the names of all services in the cluster
+func (p ECSPlugin) listServiceNames() ([]string, error) {
+	arns, err := p.listServices()
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, len(arns))
+	for i, arn := range arns {
+		// arn:aws:ecs:region:account:service/cluster/name, or service/name of the old format
+		names[i] = arn[strings.LastIndex(arn, "/")+1:]
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// describeServices describes the services, excluding (and logging) the ones which fail to describe.
+// The requests of up to describeServicesLimit services each are sent concurrently up to MaxConcurrency.
+func (p ECSPlugin) describeServices(names []string) []*ecs.Service {
+	var chunks [][]string
+	for i := 0; i < len(names); i += describeServicesLimit {
+		end := i + describeServicesLimit
+		if end > len(names) {
+			end = len(names)
+		}
+		chunks = append(chunks, names[i:end])
+	}
+
+	described := make([][]*ecs.Service, len(chunks))
+	parallel(len(chunks), p.concurrency(len(chunks)), func(i int) {
+		out, err := p.ECS.DescribeServicesWithContext(p.context(), &ecs.DescribeServicesInput{
+			Cluster:  aws.String(p.ClusterName),
+			Services: aws.StringSlice(chunks[i]),
+		})
+		if err != nil {
+			log.Printf("failed to describe services %v: %s", chunks[i], err)
+			return
+		}
+		for _, f := range out.Failures {
+			log.Printf("failed to describe service %s: %s", aws.StringValue(f.Arn), aws.StringValue(f.Reason))
+		}
+		described[i] = out.Services
+	})
+
+	var services []*ecs.Service
+	for _, s := range described {
+		services = append(services, s...)
+	}
+	return services
+}
+
+// fetchServiceTasks reports the task counts of the described services into their stat of stats.
+// Unlike CloudWatch, the ECS API reports 0 for a service scaled to zero.
+func (p ECSPlugin) fetchServiceTasks(stats map[string]map[string]float64, services []*ecs.Service) {
+	for _, s := range services {
+		stat, ok := stats[aws.StringValue(s.ServiceName)]
+		if !ok {
+			continue
+		}
+		stat["TaskRunning"] = float64(aws.Int64Value(s.RunningCount))
+		stat["TaskPending"] = float64(aws.Int64Value(s.PendingCount))
+		stat["TaskDesired"] = float64(aws.Int64Value(s.DesiredCount))
+		// more than 1 while a deployment is rolling out
+		stat["DeploymentCount"] = float64(len(s.Deployments))
+		reportDeployments(stat, s.Deployments)
+	}
+}
+
+// reportDeployments reports the deployments by status and the rollout state and failed tasks
+// of the primary deployment, which the deployment circuit breaker acts on.
+func reportDeployments(stat map[string]float64, deployments []*ecs.Deployment) {
+	stat["DeploymentPrimary"] = 0
+	stat["DeploymentActive"] = 0
+	for _, d := range deployments {
+		switch aws.StringValue(d.Status) {
+		case "PRIMARY":
+			stat["DeploymentPrimary"]++
+			// the rollout state is a gauge of 1 for the current state
+			state := aws.StringValue(d.RolloutState)
+			stat["RolloutInProgress"] = boolValue(state == ecs.DeploymentRolloutStateInProgress)
+			stat["RolloutCompleted"] = boolValue(state == ecs.DeploymentRolloutStateCompleted)
+			stat["RolloutFailed"] = boolValue(state == ecs.DeploymentRolloutStateFailed)
+			stat["DeploymentFailedTasks"] = float64(aws.Int64Value(d.FailedTasks))
+		case "ACTIVE":
+			stat["DeploymentActive"]++
+		}
+	}
+}
+
+func boolValue(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// fetchClusterTotals sums the task counts of all services in the cluster,
+// which gives the cluster total without Container Insights.
+func (p ECSPlugin) fetchClusterTotals(stat map[string]float64) {
+	arns, err := p.listServices()
+	if err != nil {
+		log.Printf("failed to list services: %s", err)
+		return
+	}
+
+	var running, pending, desired int64
+	for _, s := range p.describeServices(arns) {
+		running += aws.Int64Value(s.RunningCount)
+		pending += aws.Int64Value(s.PendingCount)
+		desired += aws.Int64Value(s.DesiredCount)
+	}
+	stat["ClusterTaskRunning"] = float64(running)
+	stat["ClusterTaskPending"] = float64(pending)
+	stat["ClusterTaskDesired"] = float64(desired)
+}
+
+// DescribeContainerInstances accepts up to 100 container instances at once
+const describeContainerInstancesLimit = 100
+
+// describeContainerInstances describes all container instances registered to the cluster,
+// excluding (and logging) the ones which fail to describe.
+func (p ECSPlugin) describeContainerInstances() ([]*ecs.ContainerInstance, error) {
+	var arns []string
+	input := &ecs.ListContainerInstancesInput{
+		Cluster: aws.String(p.ClusterName),
+	}
+	err := p.ECS.ListContainerInstancesPagesWithContext(p.context(), input, func(page *ecs.ListContainerInstancesOutput, lastPage bool) bool {
+		arns = append(arns, aws.StringValueSlice(page.ContainerInstanceArns)...)
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var instances []*ecs.ContainerInstance
+	for i := 0; i < len(arns); i += describeContainerInstancesLimit {
+		end := i + describeContainerInstancesLimit
+		if end > len(arns) {
+			end = len(arns)
+		}
+		out, err := p.ECS.DescribeContainerInstancesWithContext(p.context(), &ecs.DescribeContainerInstancesInput{
+			Cluster:            aws.String(p.ClusterName),
+			ContainerInstances: aws.StringSlice(arns[i:end]),
+		})
+		if err != nil {
+			return nil, err
+		}
+		for _, f := range out.Failures {
+			log.Printf("failed to describe container instance %s: %s", aws.StringValue(f.Arn), aws.StringValue(f.Reason))
+		}
+		instances = append(instances, out.ContainerInstances...)
+	}
+	return instances, nil
+}
@@ -0,0 +1,174 @@
+package mpawsecs
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/service/ecs"
+)
+
+func TestFetchClusterTotals(t *testing.T) {
+	// more services than a request of DescribeServices describes
+	many := make(map[string]*ecs.Service)
+	for i := 0; i < describeServicesLimit+2; i++ {
+		name := fmt.Sprintf("svc%02d", i)
+		many[name] = newService(name, 1, 0, 1)
+	}
+
+	tests := []struct {
+		name string
+		ecs  *fakeECS
+		want map[string]float64
+	}{
+		{
+			name: "all services",
+			ecs: &fakeECS{services: map[string]*ecs.Service{
+				"web":    newService("web", 3, 1, 4),
+				"worker": newService("worker", 2, 0, 2),
+			}},
+			want: map[string]float64{"ClusterTaskRunning": 5, "ClusterTaskPending": 1, "ClusterTaskDesired": 6},
+		},
+		{
+			name: "a service failing to describe",
+			ecs: &fakeECS{
+				services: map[string]*ecs.Service{
+					"web":    newService("web", 3, 1, 4),
+					"worker": newService("worker", 2, 0, 2),
+				},
+				missing: map[string]bool{"batch": true},
+			},
+			want: map[string]float64{"ClusterTaskRunning": 5, "ClusterTaskPending": 1, "ClusterTaskDesired": 6},
+		},
+		{
+			// the services of the failed request are excluded, while the others are summed
+			name: "a failing request",
+			ecs:  &fakeECS{services: many, failing: map[string]bool{"svc11": true}},
+			want: map[string]float64{
+				"ClusterTaskRunning": describeServicesLimit,
+				"ClusterTaskPending": 0,
+				"ClusterTaskDesired": describeServicesLimit,
+			},
+		},
+		{
+			name: "no services",
+			ecs:  &fakeECS{},
+			want: map[string]float64{"ClusterTaskRunning": 0, "ClusterTaskPending": 0, "ClusterTaskDesired": 0},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newTestPlugin(t, nil, tt.ecs)
+			stat := make(map[string]float64)
+			p.fetchClusterTotals(stat)
+			if !reflect.DeepEqual(stat, tt.want) {
+				t.Errorf("fetchClusterTotals() = %v, want %v", stat, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseSelector(t *testing.T) {
+	tests := []struct {
+		s           string
+		wantInclude map[string]string
+		wantExclude map[string]string
+		wantErr     bool
+	}{
+		{s: "tag:Environment=prod", wantInclude: map[string]string{"Environment": "prod"}, wantExclude: map[string]string{}},
+		{
+			s:           "tag:Environment=prod, tag:team=web,tag:stage!=canary",
+			wantInclude: map[string]string{"Environment": "prod", "team": "web"},
+			wantExclude: map[string]string{"stage": "canary"},
+		},
+		// the value may have "="
+		{s: "tag:query=a=b", wantInclude: map[string]string{"query": "a=b"}, wantExclude: map[string]string{}},
+		{s: "Environment=prod", wantErr: true},
+		{s: "label:Environment=prod", wantErr: true},
+		{s: "tag:Environment", wantErr: true},
+		{s: "tag:=prod", wantErr: true},
+		{s: "tag:env=prod,tag:env=dev", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.s, func(t *testing.T) {
+			include, exclude, err := parseSelector(tt.s)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseSelector() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if !reflect.DeepEqual(include, tt.wantInclude) || !reflect.DeepEqual(exclude, tt.wantExclude) {
+				t.Errorf("parseSelector() = %v, %v, want %v, %v", include, exclude, tt.wantInclude, tt.wantExclude)
+			}
+		})
+	}
+}
+
+func TestSelectServices(t *testing.T) {
+	e := &fakeECS{
+		services: map[string]*ecs.Service{
+			"web":    newService("web", 1, 0, 1),
+			"api":    newService("api", 1, 0, 1),
+			"canary": newService("canary", 1, 0, 1),
+			"batch":  newService("batch", 1, 0, 1),
+		},
+		tags: map[string]map[string]string{
+			"web":    {"Environment": "prod"},
+			"api":    {"Environment": "prod", "team": "api"},
+			"canary": {"Environment": "prod", "stage": "canary"},
+			"batch":  {"Environment": "dev"},
+		},
+	}
+
+	tests := []struct {
+		selector  string
+		filterTag map[string]string
+		want      []string
+	}{
+		{selector: "tag:Environment=prod", want: []string{"api", "canary", "web"}},
+		{selector: "tag:Environment=prod,tag:stage!=canary", want: []string{"api", "web"}},
+		{selector: "tag:Environment!=prod", want: []string{"batch"}},
+		// merged with -filter-tag
+		{selector: "tag:Environment=prod", filterTag: map[string]string{"team": "api"}, want: []string{"api"}},
+		{selector: "tag:Environment=staging", want: []string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.selector, func(t *testing.T) {
+			include, exclude, err := parseSelector(tt.selector)
+			if err != nil {
+				t.Fatal(err)
+			}
+			p := newTestPlugin(t, nil, e)
+			p.AllServices = true
+			p.FilterTags = map[string]string{}
+			for k, v := range tt.filterTag {
+				p.FilterTags[k] = v
+			}
+			if err := mergeTags(p.FilterTags, include); err != nil {
+				t.Fatal(err)
+			}
+			p.ExcludeTags = exclude
+			got, err := p.listServiceNames()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("listServiceNames() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMergeTags(t *testing.T) {
+	tags := map[string]string{"team": "web"}
+	if err := mergeTags(tags, map[string]string{"team": "web", "env": "prod"}); err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string]string{"team": "web", "env": "prod"}; !reflect.DeepEqual(tags, want) {
+		t.Errorf("mergeTags() = %v, want %v", tags, want)
+	}
+	if err := mergeTags(tags, map[string]string{"team": "api"}); err == nil {
+		t.Errorf("mergeTags() of a conflicting tag = nil, want an error")
+	}
+}
@@ -0,0 +1,64 @@
+package mpawsecs
+
+import (
+	"bufio"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws/endpoints"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+)
+
+// loadEndpointMap reads a file of "region=url" lines.
+// Empty lines and lines starting with "#" are ignored.
+func loadEndpointMap(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	endpointMap := make(map[string]string)
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		kv := strings.SplitN(line, "=", 2)
+		if len(kv) != 2 || strings.TrimSpace(kv[0]) == "" {
+			return nil, fmt.Errorf("%s:%d: expected region=url: %q", path, n, line)
+		}
+		region, endpoint := strings.TrimSpace(kv[0]), strings.TrimSpace(kv[1])
+		if !validEndpointURL(endpoint) {
+			return nil, fmt.Errorf("%s:%d: invalid endpoint URL for %s: %q", path, n, region, endpoint)
+		}
+		endpointMap[region] = endpoint
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return endpointMap, nil
+}
+
+// validEndpointURL reports whether endpoint is an absolute http(s) URL
+func validEndpointURL(endpoint string) bool {
+	u, err := url.Parse(endpoint)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
+
+// newEndpointResolver resolves the CloudWatch endpoint of the listed regions from endpointMap,
+// and falls back to the default resolver for everything else.
+func newEndpointResolver(endpointMap map[string]string) endpoints.Resolver {
+	return endpoints.ResolverFunc(func(service, region string, opts ...func(*endpoints.Options)) (endpoints.ResolvedEndpoint, error) {
+		if endpoint, ok := endpointMap[region]; ok && service == cloudwatch.EndpointsID {
+			return endpoints.ResolvedEndpoint{
+				URL:           endpoint,
+				SigningRegion: region,
+			}, nil
+		}
+		return endpoints.DefaultResolver().EndpointFor(service, region, opts...)
+	})
+}
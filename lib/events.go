@@ -0,0 +1,189 @@
+package mpawsecs
+
+import (
+	"log"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ecs"
+	mp "github.com/mackerelio/go-mackerel-plugin"
+)
+
+// DescribeTasks accepts up to 100 tasks at once
+const describeTasksLimit = 100
+
+// the counters of the stopped tasks by their stop code
+var stopCodeCounters = map[string]string{
+	ecs.TaskStopCodeEssentialContainerExited: "TasksStoppedEssentialContainerExited",
+	ecs.TaskStopCodeTaskFailedToStart:        "TasksStoppedFailedToStart",
+	ecs.TaskStopCodeUserInitiated:            "TasksStoppedUser",
+	// the stop codes newer than the SDK
+	"ServiceSchedulerInitiated": "TasksStoppedScheduler",
+	"SpotInterruption":          "TasksStoppedSpotInterruption",
+	"TerminationNotice":         "TasksStoppedTerminationNotice",
+}
+
+// eventSince returns since when the events and the stopped tasks of a service are counted:
+// its last scan, or a period ago on the first run or after a pause longer than the lookback.
+func (p ECSPlugin) eventSince(last, now time.Time) time.Time {
+	if last.IsZero() || !last.Before(now) || now.Sub(last) > p.Lookback {
+		return now.Add(-p.Period)
+	}
+	return last
+}
+
+// fetchTaskEvents counts the service events and the stopped tasks of the described services
+// since their last scan into their stat of stats. The time of the scan of a service is saved
+// only once both are counted, so that a failed request doesn't lose the events of its window.
+func (p ECSPlugin) fetchTaskEvents(stats map[string]map[string]float64, services []*ecs.Service) {
+	now := time.Now()
+	path := p.stateFile("events")
+	scanned := make(map[string]time.Time)
+	if err := loadState(path, &scanned); err != nil {
+		log.Printf("failed to load the last event scans (ignore): %s", err)
+	}
+
+	since := make(map[string]time.Time)
+	var names []string
+	for _, s := range services {
+		name := aws.StringValue(s.ServiceName)
+		stat, ok := stats[name]
+		if !ok {
+			continue
+		}
+		since[name] = p.eventSince(scanned[name], now)
+		countServiceEvents(stat, s.Events, since[name])
+		names = append(names, name)
+	}
+
+	counted := make([]bool, len(names))
+	parallel(len(names), p.concurrency(len(names)), func(i int) {
+		tasks, err := p.stoppedTasks(names[i])
+		if err != nil {
+			log.Printf("failed to list the stopped tasks of %s: %s", names[i], err)
+			return
+		}
+		countStoppedTasks(stats[names[i]], tasks, since[names[i]])
+		counted[i] = true
+	})
+
+	// the services no longer collected are dropped from the state
+	next := make(map[string]time.Time, len(stats))
+	for name := range stats {
+		if last, ok := scanned[name]; ok {
+			next[name] = last
+		}
+	}
+	for i, name := range names {
+		if counted[i] {
+			next[name] = now
+		}
+	}
+	if err := saveState(path, next); err != nil {
+		log.Printf("failed to save the event scans: %s", err)
+	}
+}
+
+// countServiceEvents counts the events since the time. The newest events come first.
+func countServiceEvents(stat map[string]float64, events []*ecs.ServiceEvent, since time.Time) {
+	stat["ServiceEvents"] = 0
+	stat["PlacementFailures"] = 0
+	for _, e := range events {
+		if !aws.TimeValue(e.CreatedAt).After(since) {
+			break
+		}
+		stat["ServiceEvents"]++
+		// e.g. "(service web) was unable to place a task because no container instance met all of its requirements."
+		if strings.Contains(aws.StringValue(e.Message), "was unable to place a task") {
+			stat["PlacementFailures"]++
+		}
+	}
+}
+
+// countStoppedTasks counts the tasks stopped since the time by their stop code
+func countStoppedTasks(stat map[string]float64, tasks []*ecs.Task, since time.Time) {
+	stat["TasksStopped"] = 0
+	stat["TasksStoppedOOM"] = 0
+	for _, key := range stopCodeCounters {
+		stat[key] = 0
+	}
+	for _, t := range tasks {
+		if !aws.TimeValue(t.StoppedAt).After(since) {
+			continue
+		}
+		stat["TasksStopped"]++
+		if key, ok := stopCodeCounters[aws.StringValue(t.StopCode)]; ok {
+			stat[key]++
+		}
+		// counted by its stop code too, usually EssentialContainerExited
+		for _, c := range t.Containers {
+			if strings.HasPrefix(aws.StringValue(c.Reason), "OutOfMemoryError") {
+				stat["TasksStoppedOOM"]++
+				break
+			}
+		}
+	}
+}
+
+// stoppedTasks describes the stopped tasks of the service, which ECS shows for about an hour
+func (p ECSPlugin) stoppedTasks(service string) ([]*ecs.Task, error) {
+	var arns []string
+	input := &ecs.ListTasksInput{
+		Cluster:       aws.String(p.ClusterName),
+		ServiceName:   aws.String(service),
+		DesiredStatus: aws.String(ecs.DesiredStatusStopped),
+	}
+	err := p.ECS.ListTasksPagesWithContext(p.context(), input, func(page *ecs.ListTasksOutput, lastPage bool) bool {
+		arns = append(arns, aws.StringValueSlice(page.TaskArns)...)
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var tasks []*ecs.Task
+	for i := 0; i < len(arns); i += describeTasksLimit {
+		end := i + describeTasksLimit
+		if end > len(arns) {
+			end = len(arns)
+		}
+		out, err := p.ECS.DescribeTasksWithContext(p.context(), &ecs.DescribeTasksInput{
+			Cluster: aws.String(p.ClusterName),
+			Tasks:   aws.StringSlice(arns[i:end]),
+		})
+		if err != nil {
+			return nil, err
+		}
+		tasks = append(tasks, out.Tasks...)
+	}
+	return tasks, nil
+}
+
+func (p ECSPlugin) taskEventGraphDefinition() map[string]mp.Graphs {
+	labelPrefix := p.labelPrefix()
+	return map[string]mp.Graphs{
+		"TasksStopped": {
+			Label: labelPrefix + " Tasks Stopped",
+			Unit:  "integer",
+			Metrics: []mp.Metrics{
+				{Name: "TasksStopped", Label: "Total"},
+				{Name: "TasksStoppedOOM", Label: "OOM"},
+				{Name: "TasksStoppedEssentialContainerExited", Label: "Essential Container Exited"},
+				{Name: "TasksStoppedFailedToStart", Label: "Failed To Start"},
+				{Name: "TasksStoppedScheduler", Label: "Scheduler"},
+				{Name: "TasksStoppedUser", Label: "User"},
+				{Name: "TasksStoppedSpotInterruption", Label: "Spot Interruption"},
+				{Name: "TasksStoppedTerminationNotice", Label: "Termination Notice"},
+			},
+		},
+		"ServiceEvents": {
+			Label: labelPrefix + " Service Events",
+			Unit:  "integer",
+			Metrics: []mp.Metrics{
+				{Name: "ServiceEvents", Label: "Events"},
+				{Name: "PlacementFailures", Label: "Placement Failures"},
+			},
+		},
+	}
+}
@@ -0,0 +1,127 @@
+package mpawsecs
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ecs"
+)
+
+func stoppedTask(arn, stopCode string, stoppedAt time.Time) *ecs.Task {
+	return &ecs.Task{
+		TaskArn:   aws.String(arn),
+		StopCode:  aws.String(stopCode),
+		StoppedAt: aws.Time(stoppedAt),
+	}
+}
+
+func TestFetchTaskEventsDescribesOnce(t *testing.T) {
+	var mu sync.Mutex
+	describes := 0
+	e := &fakeECS{
+		services: map[string]*ecs.Service{
+			"web":    newService("web", 2, 0, 2),
+			"worker": newService("worker", 1, 0, 1),
+		},
+		before: func() {
+			mu.Lock()
+			describes++
+			mu.Unlock()
+		},
+	}
+	p := newTestPlugin(t, &fakeCloudWatch{}, e)
+	p.ServiceName = "web,worker"
+	p.EmitTaskEvents = true
+
+	stat, err := p.FetchMetrics()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the services of a single request of DescribeServices
+	if describes != 1 {
+		t.Errorf("DescribeServices was called %d times, want 1", describes)
+	}
+	for _, key := range []string{"web.Task.TaskRunning", "web.TasksStopped.TasksStopped", "worker.ServiceEvents.ServiceEvents"} {
+		if _, ok := stat[key]; !ok {
+			t.Errorf("%s not reported", key)
+		}
+	}
+}
+
+func TestFetchTaskEventsWindow(t *testing.T) {
+	now := time.Now()
+	e := &fakeECS{
+		services: map[string]*ecs.Service{
+			"web":    newService("web", 2, 0, 2),
+			"worker": newService("worker", 1, 0, 1),
+		},
+		stopped: map[string][]*ecs.Task{
+			"web":    {stoppedTask("web-1", ecs.TaskStopCodeEssentialContainerExited, now.Add(-30*time.Second))},
+			"worker": {stoppedTask("worker-1", ecs.TaskStopCodeTaskFailedToStart, now.Add(-30*time.Second))},
+		},
+		failingTasks: map[string]bool{"worker": true},
+	}
+	p := newTestPlugin(t, &fakeCloudWatch{}, e)
+	p.ServiceName = "web,worker"
+	p.EmitTaskEvents = true
+	stats := func() map[string]map[string]float64 {
+		return map[string]map[string]float64{"web": {}, "worker": {}}
+	}
+	services := []*ecs.Service{e.services["web"], e.services["worker"]}
+
+	first := stats()
+	p.fetchTaskEvents(first, services)
+	if got := first["web"]["TasksStoppedEssentialContainerExited"]; got != 1 {
+		t.Errorf("TasksStoppedEssentialContainerExited of web = %v, want 1", got)
+	}
+	if _, ok := first["worker"]["TasksStopped"]; ok {
+		t.Errorf("TasksStopped of worker reported though its tasks failed to list")
+	}
+
+	scanned := make(map[string]time.Time)
+	if err := loadState(p.stateFile("events"), &scanned); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := scanned["web"]; !ok {
+		t.Errorf("the scan of web is not saved")
+	}
+	if _, ok := scanned["worker"]; ok {
+		t.Errorf("the failed scan of worker is saved")
+	}
+
+	// the next run counts the task of worker in the window lost by the failure,
+	// and no longer the one of web counted already
+	e.failingTasks = nil
+	second := stats()
+	p.fetchTaskEvents(second, services)
+	if got := second["worker"]["TasksStoppedFailedToStart"]; got != 1 {
+		t.Errorf("TasksStoppedFailedToStart of worker = %v, want 1", got)
+	}
+	if got := second["web"]["TasksStopped"]; got != 0 {
+		t.Errorf("TasksStopped of web = %v, want 0", got)
+	}
+}
+
+func TestEventSince(t *testing.T) {
+	now := time.Now()
+	p := ECSPlugin{Period: time.Minute, Lookback: 5 * time.Minute}
+	tests := []struct {
+		name string
+		last time.Time
+		want time.Time
+	}{
+		{name: "first run", want: now.Add(-time.Minute)},
+		{name: "last run", last: now.Add(-2 * time.Minute), want: now.Add(-2 * time.Minute)},
+		{name: "after a pause", last: now.Add(-time.Hour), want: now.Add(-time.Minute)},
+		{name: "in the future", last: now.Add(time.Minute), want: now.Add(-time.Minute)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := p.eventSince(tt.last, now); !got.Equal(tt.want) {
+				t.Errorf("eventSince() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,118 @@
+package mpawsecs
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+)
+
+// metricStreamRecord is a record of the JSON output format of CloudWatch Metric Streams
+// https://docs.aws.amazon.com/AmazonCloudWatch/latest/monitoring/CloudWatch-metric-streams-formats-json.html
+type metricStreamRecord struct {
+	Namespace  string            `json:"namespace"`
+	MetricName string            `json:"metric_name"`
+	Dimensions map[string]string `json:"dimensions"`
+	Timestamp  int64             `json:"timestamp"`
+	Value      struct {
+		Max   float64 `json:"max"`
+		Min   float64 `json:"min"`
+		Sum   float64 `json:"sum"`
+		Count float64 `json:"count"`
+	} `json:"value"`
+}
+
+// loadMetricStream reads the records delivered by a metric stream to a local file.
+func loadMetricStream(path string) ([]metricStreamRecord, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var records []metricStreamRecord
+	dec := json.NewDecoder(f)
+	for {
+		var r metricStreamRecord
+		if err := dec.Decode(&r); err != nil {
+			if err == io.EOF {
+				return records, nil
+			}
+			return nil, err
+		}
+		records = append(records, r)
+	}
+}
+
+func (r metricStreamRecord) hasDimensions(dimensions []*cloudwatch.Dimension) bool {
+	if len(r.Dimensions) != len(dimensions) {
+		return false
+	}
+	for _, d := range dimensions {
+		if v, ok := r.Dimensions[*d.Name]; !ok || v != *d.Value {
+			return false
+		}
+	}
+	return true
+}
+
+// statistic returns the value of the statistic. The records have no percentiles.
+func (r metricStreamRecord) statistic(metricsType string) (float64, bool) {
+	switch metricsType {
+	case metricsTypeAverage:
+		return r.Value.Sum / r.Value.Count, true
+	case metricsTypeMinimum:
+		return r.Value.Min, true
+	case metricsTypeMaximum:
+		return r.Value.Max, true
+	case metricsTypeSampleCount:
+		return r.Value.Count, true
+	case metricsTypeSum:
+		return r.Value.Sum, true
+	}
+	return 0, false
+}
+
+// streamSeries collects the matching records in the window into a series
+// as GetMetricData would return.
+func streamSeries(records []metricStreamRecord, q query, window time.Duration) (series, error) {
+	since := time.Now().Add(-window)
+	var s series
+	for _, r := range records {
+		if r.Namespace != q.namespace || r.MetricName != q.metric.Name || !r.hasDimensions(q.dimensions) {
+			continue
+		}
+		ts := time.Unix(0, r.Timestamp*int64(time.Millisecond))
+		v, ok := r.statistic(q.metric.Type)
+		if ts.Before(since) || r.Value.Count == 0 || !ok {
+			continue
+		}
+		s.timestamps = append(s.timestamps, ts)
+		s.values = append(s.values, v)
+	}
+	if s.Len() == 0 {
+		return s, errNoDatapoints
+	}
+	sort.Sort(s)
+	return s, nil
+}
+
+// streamContainers returns the container names found in the records of the service.
+func streamContainers(records []metricStreamRecord, clusterName, serviceName string) []string {
+	seen := make(map[string]bool)
+	var containers []string
+	for _, r := range records {
+		if r.Namespace != containerInsightsNamespace || len(r.Dimensions) != 3 ||
+			r.Dimensions["ClusterName"] != clusterName || r.Dimensions["ServiceName"] != serviceName {
+			continue
+		}
+		if c, ok := r.Dimensions["ContainerName"]; ok && !seen[c] {
+			seen[c] = true
+			containers = append(containers, c)
+		}
+	}
+	return containers
+}
@@ -0,0 +1,197 @@
+package mpawsecs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/client"
+)
+
+// Option configures the plugin built by New
+type Option func(*ECSPlugin)
+
+// WithClusterName sets the cluster to monitor, or comma separated clusters
+func WithClusterName(name string) Option {
+	return func(p *ECSPlugin) { p.ClusterName = name }
+}
+
+// WithServiceName sets the service to monitor, or comma separated services
+func WithServiceName(name string) Option {
+	return func(p *ECSPlugin) { p.ServiceName = name }
+}
+
+// WithRegion sets the region. Without it, the region of the profile or of the EC2 instance is used.
+func WithRegion(region string) Option {
+	return func(p *ECSPlugin) { p.Region = region }
+}
+
+// WithPrefix sets the metric key prefix, "ECS" by default
+func WithPrefix(prefix string) Option {
+	return func(p *ECSPlugin) { p.Prefix = prefix }
+}
+
+// WithStaticCredentials sets the access key to query AWS with
+func WithStaticCredentials(accessKeyID, secretAccessKey string) Option {
+	return func(p *ECSPlugin) {
+		p.AccessKeyID = accessKeyID
+		p.SecretAccessKey = secretAccessKey
+	}
+}
+
+// WithProfile sets the shared credentials profile
+func WithProfile(profile string) Option {
+	return func(p *ECSPlugin) { p.Profile = profile }
+}
+
+// WithAssumeRole sets the IAM role to assume, with an optional external ID
+func WithAssumeRole(roleARN, externalID string) Option {
+	return func(p *ECSPlugin) {
+		p.AssumeRoleARN = roleARN
+		p.ExternalID = externalID
+	}
+}
+
+// WithPeriod sets the period and the lookback window of the CloudWatch datapoints
+func WithPeriod(period, lookback time.Duration) Option {
+	return func(p *ECSPlugin) {
+		p.Period = period
+		p.Lookback = lookback
+	}
+}
+
+// WithStatistics sets the statistics of the CloudWatch metrics, e.g. Average and Maximum
+func WithStatistics(statistics ...string) Option {
+	return func(p *ECSPlugin) { p.Statistics = statistics }
+}
+
+// New builds the plugin with the options and prepares its AWS clients, as Do does
+// from the flags. The other exported fields of ECSPlugin may be set with an Option
+// of a custom func before the clients are prepared. The fields not set default to
+// the defaults of the flags.
+func New(opts ...Option) (*ECSPlugin, error) {
+	p := &ECSPlugin{
+		StartedAt:                 time.Now(),
+		Prefix:                    "ECS",
+		Namespace:                 namespace,
+		LaunchType:                launchTypeEC2,
+		Source:                    sourceCloudWatch,
+		TaskCountSource:           taskCountECS,
+		FillMissing:               fillSkip,
+		Period:                    defaultPeriod,
+		Lookback:                  defaultLookback,
+		MaxRetries:                defaultMaxRetries,
+		RetryThrottleDelay:        client.DefaultRetryerMinThrottleDelay,
+		RetryMaxDelay:             client.DefaultRetryerMaxRetryDelay,
+		Timeout:                   defaultTimeout,
+		DiscoveryCacheTTL:         defaultDiscoveryCacheTTL,
+		UtilizationBandBoundaries: defaultUtilizationBands,
+	}
+	for _, opt := range opts {
+		opt(p)
+	}
+	if err := p.checkOptions(); err != nil {
+		return nil, err
+	}
+	if err := p.prepare(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// checkOptions checks the values and the combinations of the options, of both New and the flags
+func (p ECSPlugin) checkOptions() error {
+	// the cluster of the task is taken from the Task Metadata Endpoint
+	if p.ClusterName == "" && p.Source != sourceMetadata {
+		return errors.New("cluster-name is required")
+	}
+	if p.LaunchType != launchTypeEC2 && p.LaunchType != launchTypeFargate {
+		return fmt.Errorf("unknown launch type: %s", p.LaunchType)
+	}
+	if p.Source != sourceCloudWatch && p.Source != sourceMetadata {
+		return fmt.Errorf("unknown source: %s (expected cloudwatch or metadata)", p.Source)
+	}
+	if p.TaskCountSource != taskCountECS && p.TaskCountSource != taskCountCloudWatch {
+		return fmt.Errorf("unknown task-count-source: %s (expected ecs or cloudwatch)", p.TaskCountSource)
+	}
+	if p.FillMissing != fillSkip && p.FillMissing != fillZero && p.FillMissing != fillLast {
+		return fmt.Errorf("unknown fill-missing: %s (expected skip, zero or last)", p.FillMissing)
+	}
+	if _, err := parseStatistics(strings.Join(p.statistics(), ",")); err != nil {
+		return err
+	}
+	if _, err := parseExtendedStatistics(strings.Join(p.ExtendedStatistics, ",")); err != nil {
+		return err
+	}
+	if p.MaxRetries < 0 {
+		return fmt.Errorf("max-retries must not be negative: %d", p.MaxRetries)
+	}
+	if p.RetryThrottleDelay <= 0 || p.RetryMaxDelay < p.RetryThrottleDelay {
+		return fmt.Errorf("retry-throttle-delay (%s) must be positive and at most retry-max-delay (%s)", p.RetryThrottleDelay, p.RetryMaxDelay)
+	}
+	if p.Timeout <= 0 {
+		return fmt.Errorf("timeout must be positive: %s", p.Timeout)
+	}
+	if p.MaxConcurrency < 0 {
+		return fmt.Errorf("max-concurrency must not be negative: %d", p.MaxConcurrency)
+	}
+	if p.DatapointLag < 0 {
+		return fmt.Errorf("datapoint-lag must not be negative: %s", p.DatapointLag)
+	}
+	if p.ZeroGrace < 0 {
+		return fmt.Errorf("zero-grace-seconds must not be negative: %s", p.ZeroGrace)
+	}
+	if p.ZeroGrace > 0 && p.ServiceName == "" && !p.AllServices {
+		return errors.New("zero-grace-seconds requires service-name or all-services")
+	}
+	if p.TrimmedMeanPercent < 0 || p.TrimmedMeanPercent >= 50 {
+		return fmt.Errorf("trimmed-mean-percent must be in [0, 50): %f", p.TrimmedMeanPercent)
+	}
+	if p.EmitUtilizationBands && len(p.UtilizationBandBoundaries) == 0 {
+		return errors.New("emit-utilization-bands requires utilization-bands")
+	}
+	if (len(p.FilterTags) > 0 || len(p.ExcludeTags) > 0) && !p.AllServices && !p.EmitClusterTotals {
+		return errors.New("filter-tag and exclude-tag require all-services or emit-cluster-totals")
+	}
+	if p.TaskDefinitionFamily != "" && (p.ServiceName != "" || p.AllServices) {
+		return errors.New("task-definition-family cannot be used with service-name or all-services")
+	}
+	if p.AllServices && p.ServiceName != "" {
+		return errors.New("all-services cannot be used with service-name")
+	}
+	if p.EmitAutoscaling && p.ServiceName == "" && !p.AllServices {
+		return errors.New("emit-autoscaling requires service-name or all-services")
+	}
+	if p.EmitTaskEvents && p.ServiceName == "" && !p.AllServices {
+		return errors.New("emit-task-events requires service-name or all-services")
+	}
+	if p.TopN < 0 {
+		return fmt.Errorf("top-n must not be negative: %d", p.TopN)
+	}
+	if p.TopN > 0 && !p.multiService() {
+		return errors.New("top-n requires all-services or multiple services")
+	}
+	if p.EmitServiceRollup && !p.multiService() {
+		return errors.New("emit-service-rollup requires all-services or multiple services")
+	}
+	if p.TargetGroupARN != "" && p.multiService() {
+		return errors.New("lb-target-group-arn cannot be used with multiple services")
+	}
+	if p.multiCluster() && (p.ServiceName != "" || p.AllServices || p.TaskDefinitionFamily != "" || p.TargetGroupARN != "" || p.EmitClusterTotals || p.EmitCapacityProviders || p.WithContainerInstances) {
+		return errors.New("multiple clusters cannot be used with service-name, all-services, task-definition-family, lb-target-group-arn, emit-cluster-totals, emit-capacity-providers or with-container-instances")
+	}
+	if p.Source == sourceMetadata && (p.multiCluster() || p.ServiceName != "" || p.AllServices || p.TaskDefinitionFamily != "" || p.TargetGroupARN != "" || p.EmitClusterTotals || p.EmitCapacityProviders || p.WithContainerInstances || p.IncludeClusterReservation || p.MetricStreamFile != "" || p.FallbackRegion != "") {
+		return errors.New("source metadata cannot be used with multiple clusters, service-name, all-services, task-definition-family, lb-target-group-arn, emit-cluster-totals, emit-capacity-providers, with-container-instances, include-cluster-reservation, metric-stream-file or fallback-region")
+	}
+	return nil
+}
+
+// FetchMetricsWithContext fetches the metrics as FetchMetrics does. When ctx is done,
+// the pending requests are canceled and the metrics fetched so far are returned.
+func (p ECSPlugin) FetchMetricsWithContext(ctx context.Context) (map[string]float64, error) {
+	// p is a copy, so ctx applies to this fetch only
+	p.ctx = ctx
+	return p.FetchMetrics()
+}
@@ -0,0 +1,123 @@
+package mpawsecs
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNew(t *testing.T) {
+	for _, env := range []string{"AWS_PROFILE", "AWS_REGION", "AWS_SDK_LOAD_CONFIG"} {
+		t.Setenv(env, "")
+	}
+	p, err := New(WithClusterName("test"), WithServiceName("web"), WithRegion("ap-northeast-1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the same defaults as the flags
+	if p.MaxRetries != defaultMaxRetries {
+		t.Errorf("MaxRetries = %d, want %d", p.MaxRetries, defaultMaxRetries)
+	}
+	if p.Timeout != defaultTimeout {
+		t.Errorf("Timeout = %s, want %s", p.Timeout, defaultTimeout)
+	}
+	if p.DiscoveryCacheTTL != defaultDiscoveryCacheTTL {
+		t.Errorf("DiscoveryCacheTTL = %s, want %s", p.DiscoveryCacheTTL, defaultDiscoveryCacheTTL)
+	}
+	if got := p.labelPrefix(); got != "ECS" {
+		t.Errorf("labelPrefix() = %q, want %q", got, "ECS")
+	}
+	if _, ok := p.GraphDefinition()["Task"]; !ok {
+		t.Errorf("GraphDefinition() has no Task graph of the ECS API")
+	}
+}
+
+func TestNewInvalidOptions(t *testing.T) {
+	tests := []struct {
+		name    string
+		opt     Option
+		wantErr string
+	}{
+		{
+			name:    "no cluster",
+			opt:     WithClusterName(""),
+			wantErr: "cluster-name is required",
+		},
+		{
+			name:    "launch type",
+			opt:     func(p *ECSPlugin) { p.LaunchType = "lambda" },
+			wantErr: "unknown launch type",
+		},
+		{
+			name:    "fill missing",
+			opt:     func(p *ECSPlugin) { p.FillMissing = "previous" },
+			wantErr: "unknown fill-missing",
+		},
+		{
+			name:    "source",
+			opt:     func(p *ECSPlugin) { p.Source = "prometheus" },
+			wantErr: "unknown source",
+		},
+		{
+			name:    "task count source",
+			opt:     func(p *ECSPlugin) { p.TaskCountSource = "insights" },
+			wantErr: "unknown task-count-source",
+		},
+		{
+			name:    "statistics",
+			opt:     WithStatistics(metricsTypeAverage, "Median"),
+			wantErr: `unknown statistic "Median"`,
+		},
+		{
+			name:    "retry delays",
+			opt:     func(p *ECSPlugin) { p.RetryMaxDelay = time.Millisecond },
+			wantErr: "retry-throttle-delay",
+		},
+		{
+			name:    "negative max retries",
+			opt:     func(p *ECSPlugin) { p.MaxRetries = -1 },
+			wantErr: "max-retries must not be negative",
+		},
+		{
+			name:    "negative zero grace",
+			opt:     func(p *ECSPlugin) { p.ZeroGrace = -time.Second },
+			wantErr: "zero-grace-seconds must not be negative",
+		},
+		{
+			name: "zero grace of the cluster",
+			opt: func(p *ECSPlugin) {
+				p.ServiceName = ""
+				p.ZeroGrace = time.Minute
+			},
+			wantErr: "zero-grace-seconds requires service-name or all-services",
+		},
+		{
+			name:    "all services with a service",
+			opt:     func(p *ECSPlugin) { p.AllServices = true },
+			wantErr: "all-services cannot be used with service-name",
+		},
+		{
+			name:    "top-n of a service",
+			opt:     func(p *ECSPlugin) { p.TopN = 3 },
+			wantErr: "top-n requires all-services or multiple services",
+		},
+		{
+			name:    "service rollup of a service",
+			opt:     func(p *ECSPlugin) { p.EmitServiceRollup = true },
+			wantErr: "emit-service-rollup requires all-services or multiple services",
+		},
+		{
+			name:    "multiple clusters with a service",
+			opt:     WithClusterName("prod,staging"),
+			wantErr: "multiple clusters cannot be used with service-name",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := New(WithClusterName("test"), WithServiceName("web"), WithRegion("ap-northeast-1"), tt.opt)
+			if err == nil || !strings.HasPrefix(err.Error(), tt.wantErr) {
+				t.Errorf("New() = %v, want %s", err, tt.wantErr)
+			}
+		})
+	}
+}
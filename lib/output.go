@@ -0,0 +1,125 @@
+package mpawsecs
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	mp "github.com/mackerelio/go-mackerel-plugin"
+)
+
+// metricValues maps stat into the values keyed by their full metric key such as
+// "ECS.CPUUtilization.CPUUtilizationAverage", as go-mackerel-plugin names them.
+func (p ECSPlugin) metricValues(stat map[string]float64) map[string]float64 {
+	return p.mapMetricKeys(stat, true)
+}
+
+// mapMetricKeys maps stat into the full metric keys, with the values multiplied
+// by the scale of their metric if scaled
+func (p ECSPlugin) mapMetricKeys(stat map[string]float64, scaled bool) map[string]float64 {
+	prefix := p.MetricKeyPrefix()
+	values := make(map[string]float64)
+	for key, graph := range p.GraphDefinition() {
+		for _, metric := range graph.Metrics {
+			wildcard := strings.ContainsAny(key+metric.Name, "*#")
+			for _, k := range graphStatKeys(key, metric, stat) {
+				v := stat[k]
+				if scaled && metric.Scale != 0 {
+					v *= metric.Scale
+				}
+				// the keys of wildcard metrics already include the graph key
+				if wildcard {
+					values[prefix+"."+k] = v
+				} else {
+					values[prefix+"."+key+"."+k] = v
+				}
+			}
+		}
+	}
+	return values
+}
+
+func sortedKeys(values map[string]float64) []string {
+	keys := make([]string, 0, len(values))
+	for k := range values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// outputValues prints the metrics in the same format as go-mackerel-plugin,
+// but sorted by the metric key so that identical values produce identical output.
+// Diff metrics are not supported since this plugin has none.
+func (p ECSPlugin) outputValues(w io.Writer) {
+	now := time.Now()
+	if p.EmitDatapointTime {
+		// p is a copy, so the times are of this fetch only
+		p.times = make(map[string]float64)
+	}
+	stat, err := p.FetchMetrics()
+	if err != nil {
+		log.Fatalln("OutputValues: ", err)
+	}
+
+	values := p.metricValues(stat)
+	var times, emitted map[string]float64
+	if p.EmitDatapointTime {
+		times = p.mapMetricKeys(p.times, false)
+		emitted = p.loadEmitted()
+	}
+	for _, key := range sortedKeys(values) {
+		value := values[key]
+		if math.IsNaN(value) || math.IsInf(value, 0) {
+			log.Printf("Invalid value: key = %s, value = %f\n", key, value)
+			continue
+		}
+		// the values not of a datapoint, such as the ECS API ones, are emitted at now
+		t, ok := times[key]
+		if !ok {
+			t = float64(now.Unix())
+		} else if t <= emitted[key] {
+			p.debugf("%s: the datapoint at %s was already emitted", key, time.Unix(int64(t), 0).UTC().Format(time.RFC3339))
+			continue
+		}
+		if value == float64(int(value)) {
+			fmt.Fprintf(w, "%s\t%d\t%d\n", key, int(value), int64(t))
+		} else {
+			fmt.Fprintf(w, "%s\t%f\t%d\n", key, value, int64(t))
+		}
+	}
+	if p.EmitDatapointTime {
+		p.saveEmitted(times)
+	}
+}
+
+// loadEmitted returns the unix times of the datapoints emitted last time by their metric keys.
+// They are kept apart from the values of dropUnchanged, which is keyed by the stat keys.
+func (p ECSPlugin) loadEmitted() map[string]float64 {
+	var emitted map[string]float64
+	if err := loadState(p.stateFile("datapoint-times"), &emitted); err != nil {
+		log.Printf("failed to load the emitted datapoints (ignore): %s", err)
+	}
+	return emitted
+}
+
+func (p ECSPlugin) saveEmitted(times map[string]float64) {
+	if err := saveState(p.stateFile("datapoint-times"), times); err != nil {
+		log.Printf("failed to save the emitted datapoints: %s", err)
+	}
+}
+
+// run outputs the graph definitions or the values as mp.MackerelPlugin.Run does.
+func (p ECSPlugin) run() {
+	if os.Getenv("MACKEREL_AGENT_PLUGIN_META") != "" {
+		helper := mp.NewMackerelPlugin(p)
+		helper.OutputDefinitions()
+		return
+	}
+	p.outputValues(os.Stdout)
+}
@@ -0,0 +1,138 @@
+package mpawsecs
+
+import (
+	"bytes"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/ecs"
+)
+
+// outputKeys returns the metric keys of the lines of outputValues
+func outputKeys(out string) []string {
+	var keys []string
+	for _, line := range strings.Split(strings.TrimSpace(out), "\n") {
+		if line != "" {
+			keys = append(keys, strings.Split(line, "\t")[0])
+		}
+	}
+	return keys
+}
+
+func TestOutputValuesChangedOnlyWithDatapointTime(t *testing.T) {
+	now := time.Now().Truncate(time.Minute)
+	// the points of a run, whose least recent one is at the minute
+	pointsAt := func(minute time.Duration, cpu, memory float64) map[string][]point {
+		return map[string][]point{
+			"web CPUUtilization Average":    {{now.Add(-minute), cpu}, {now.Add(-minute + time.Minute), cpu}},
+			"web MemoryUtilization Average": {{now.Add(-minute), memory}, {now.Add(-minute + time.Minute), memory}},
+		}
+	}
+
+	cw := &fakeCloudWatch{}
+	e := &fakeECS{services: map[string]*ecs.Service{"web": newService("web", 2, 0, 2)}}
+	p := newTestPlugin(t, cw, e)
+	p.ServiceName = "web"
+	p.Statistics = []string{metricsTypeAverage}
+	p.EmitChangedOnly = true
+	p.EmitDatapointTime = true
+
+	tests := []struct {
+		name   string
+		points map[string][]point
+		want   []string
+	}{
+		{
+			name:   "first run",
+			points: pointsAt(3*time.Minute, 10, 50),
+			want: []string{
+				"ECS.CPUUtilization.CPUUtilizationAverage",
+				"ECS.Deployment.DeploymentActive",
+				"ECS.Deployment.DeploymentCount",
+				"ECS.Deployment.DeploymentPrimary",
+				"ECS.DeploymentFailedTasks.DeploymentFailedTasks",
+				"ECS.MemoryUtilization.MemoryUtilizationAverage",
+				"ECS.Rollout.RolloutCompleted",
+				"ECS.Rollout.RolloutFailed",
+				"ECS.Rollout.RolloutInProgress",
+				"ECS.Task.TaskDesired",
+				"ECS.Task.TaskPending",
+				"ECS.Task.TaskRunning",
+			},
+		},
+		{
+			name:   "same datapoints",
+			points: pointsAt(3*time.Minute, 10, 50),
+		},
+		{
+			name:   "new datapoints of the same values",
+			points: pointsAt(2*time.Minute, 10, 50),
+		},
+		{
+			name:   "new datapoint of a changed value",
+			points: pointsAt(time.Minute, 10, 60),
+			want:   []string{"ECS.MemoryUtilization.MemoryUtilizationAverage"},
+		},
+	}
+	for _, tt := range tests {
+		cw.points = tt.points
+		var out bytes.Buffer
+		p.outputValues(&out)
+		if got := outputKeys(out.String()); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: outputValues() emitted %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestOutputValuesDeterministic(t *testing.T) {
+	cw := &fakeCloudWatch{points: make(map[string][]point)}
+	services := make(map[string]*ecs.Service)
+	for _, name := range []string{"web", "worker", "batch", "api"} {
+		services[name] = newService(name, 2, 1, 3)
+		for _, m := range []string{"CPUUtilization", "MemoryUtilization"} {
+			for _, stat := range defaultStatistics {
+				cw.points[name+" "+m+" "+stat] = minutesAgo(12.5, 13)
+			}
+		}
+	}
+	p := newTestPlugin(t, cw, &fakeECS{services: services})
+	p.ServiceName = "web,worker,batch,api"
+	p.TopN = 2
+	p.EmitClusterTotals = true
+	p.EmitUtilizationBands = true
+	p.UtilizationBandBoundaries = defaultUtilizationBands
+
+	// the values are emitted at now, which differs between the runs
+	withoutTime := func(out string) string {
+		var lines []string
+		for _, line := range strings.Split(strings.TrimSpace(out), "\n") {
+			fields := strings.Split(line, "\t")
+			lines = append(lines, strings.Join(fields[:2], "\t"))
+		}
+		return strings.Join(lines, "\n")
+	}
+
+	var first string
+	for i := 0; i < 5; i++ {
+		var out bytes.Buffer
+		p.outputValues(&out)
+		got := withoutTime(out.String())
+		if i == 0 {
+			first = got
+			keys := outputKeys(out.String())
+			if !sort.StringsAreSorted(keys) {
+				t.Errorf("outputValues() emitted the keys out of order: %v", keys)
+			}
+			if len(keys) < 50 {
+				t.Fatalf("outputValues() emitted %d metrics, want the metrics of all services", len(keys))
+			}
+			continue
+		}
+		if got != first {
+			t.Fatalf("run %d: outputValues() = %q, want %q", i+1, got, first)
+		}
+	}
+}
@@ -0,0 +1,39 @@
+package mpawsecs
+
+import (
+	"runtime"
+	"sync"
+)
+
+// concurrency returns the max number of concurrent requests of n jobs.
+// MaxConcurrency of 0 sizes the pool automatically to min(n, 2*NumCPU): the jobs are
+// requests, e.g. a GetMetricData request of up to 500 metrics, so a small run doesn't
+// start more goroutines than it has requests. A job mostly waits on the network, and
+// twice the CPUs keeps a request in flight while another one's response is decoded.
+func (p ECSPlugin) concurrency(n int) int {
+	limit := p.MaxConcurrency
+	if limit <= 0 {
+		limit = 2 * runtime.NumCPU()
+	}
+	if limit > n {
+		limit = n
+	}
+	return limit
+}
+
+// parallel calls job(i) for each 0 <= i < n, running up to limit of them at once.
+// The jobs must not write to the same variables without a lock.
+func parallel(n, limit int, job func(i int)) {
+	sem := make(chan struct{}, limit)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			job(i)
+		}(i)
+	}
+	wg.Wait()
+}
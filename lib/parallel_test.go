@@ -0,0 +1,62 @@
+package mpawsecs
+
+import (
+	"runtime"
+	"sync"
+	"testing"
+)
+
+func TestConcurrency(t *testing.T) {
+	auto := 2 * runtime.NumCPU()
+	tests := []struct {
+		name           string
+		maxConcurrency int
+		n              int
+		want           int
+	}{
+		{name: "auto of no jobs", n: 0, want: 0},
+		{name: "auto of a single request", n: 1, want: 1},
+		{name: "auto of as many jobs as the pool", n: auto, want: auto},
+		{name: "auto of more jobs than the pool", n: auto + 5, want: auto},
+		{name: "auto of many jobs", n: 1000, want: auto},
+		{name: "explicit of fewer jobs", maxConcurrency: 8, n: 3, want: 3},
+		{name: "explicit of more jobs", maxConcurrency: 8, n: 20, want: 8},
+		{name: "explicit of 1", maxConcurrency: 1, n: 20, want: 1},
+		{name: "explicit above the CPUs", maxConcurrency: auto + 10, n: 1000, want: auto + 10},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := ECSPlugin{MaxConcurrency: tt.maxConcurrency}
+			if got := p.concurrency(tt.n); got != tt.want {
+				t.Errorf("concurrency(%d) = %d, want %d", tt.n, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParallel(t *testing.T) {
+	var mu sync.Mutex
+	var running, peak int
+	done := make([]bool, 20)
+	parallel(len(done), 3, func(i int) {
+		mu.Lock()
+		running++
+		if running > peak {
+			peak = running
+		}
+		mu.Unlock()
+		runtime.Gosched()
+		mu.Lock()
+		running--
+		done[i] = true
+		mu.Unlock()
+	})
+	if peak > 3 {
+		t.Errorf("%d jobs ran at once, want at most 3", peak)
+	}
+	for i, ok := range done {
+		if !ok {
+			t.Errorf("job %d not run", i)
+		}
+	}
+}
@@ -0,0 +1,106 @@
+package mpawsecs
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+var prefixReg = regexp.MustCompile(`^[-a-zA-Z0-9_]+$`)
+
+// parsePrefixMap parses comma separated cluster[/service]=prefix entries of -prefix-map
+// such as "prod=ECSProd,staging/web=ECSStagingWeb"
+func parsePrefixMap(s string) (map[string]string, error) {
+	prefixMap := make(map[string]string)
+	if s == "" {
+		return prefixMap, nil
+	}
+	for _, entry := range strings.Split(s, ",") {
+		target, prefix, ok := strings.Cut(strings.TrimSpace(entry), "=")
+		if !ok || target == "" || strings.HasPrefix(target, "/") || strings.HasSuffix(target, "/") || strings.Count(target, "/") > 1 {
+			return nil, fmt.Errorf("invalid prefix map %q: expected cluster[/service]=prefix", entry)
+		}
+		if !prefixReg.MatchString(prefix) {
+			return nil, fmt.Errorf("invalid prefix map %q: the prefix must be of [-a-zA-Z0-9_]", entry)
+		}
+		if _, dup := prefixMap[target]; dup {
+			return nil, fmt.Errorf("duplicate prefix map of %s", target)
+		}
+		prefixMap[target] = prefix
+	}
+	return prefixMap, nil
+}
+
+// splitByPrefixMap splits the clusters, or the services of the cluster, into a plugin
+// for each prefix of PrefixMap. A service is mapped by "cluster/service", or else by its
+// cluster, and the targets mapped by neither stay under the prefix of p.
+func (p ECSPlugin) splitByPrefixMap() ([]ECSPlugin, error) {
+	if len(p.PrefixMap) == 0 {
+		return []ECSPlugin{p}, nil
+	}
+
+	used := make(map[string]bool)
+	resolve := func(targets ...string) string {
+		for _, t := range targets {
+			if prefix, ok := p.PrefixMap[t]; ok {
+				used[t] = true
+				return prefix
+			}
+		}
+		return p.MetricKeyPrefix()
+	}
+
+	// the clusters or services of each prefix, in the order of the flags
+	var prefixes []string
+	members := make(map[string][]string)
+	add := func(prefix, name string) {
+		if _, ok := members[prefix]; !ok {
+			prefixes = append(prefixes, prefix)
+		}
+		members[prefix] = append(members[prefix], name)
+	}
+	services := splitNames(p.ServiceName)
+	if len(services) == 0 {
+		for _, c := range p.clusterNames() {
+			add(resolve(c), c)
+		}
+	} else {
+		for _, s := range services {
+			add(resolve(p.ClusterName+"/"+s, p.ClusterName), s)
+		}
+	}
+	for target := range p.PrefixMap {
+		if !used[target] {
+			return nil, fmt.Errorf("prefix-map of %s matches no cluster or service of cluster-name and service-name", target)
+		}
+	}
+
+	plugins := make([]ECSPlugin, len(prefixes))
+	for i, prefix := range prefixes {
+		sp := p
+		sp.Prefix, sp.PrefixMap = prefix, nil
+		if len(services) == 0 {
+			sp.ClusterName = strings.Join(members[prefix], ",")
+		} else {
+			sp.ServiceName = strings.Join(members[prefix], ",")
+		}
+		if err := sp.checkOptions(); err != nil {
+			return nil, fmt.Errorf("prefix %s of prefix-map: %s", prefix, err)
+		}
+		plugins[i] = sp
+	}
+	return plugins, nil
+}
+
+// checkUniquePrefixes fails when two plugins share a prefix, which they tell
+// their metric keys and state files apart by
+func checkUniquePrefixes(plugins []ECSPlugin) error {
+	seen := make(map[string]bool)
+	for _, p := range plugins {
+		if seen[p.MetricKeyPrefix()] {
+			return fmt.Errorf("metric-key-prefix %q of prefix-map is used by another target", p.MetricKeyPrefix())
+		}
+		seen[p.MetricKeyPrefix()] = true
+	}
+	return nil
+}
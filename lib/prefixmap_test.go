@@ -0,0 +1,177 @@
+package mpawsecs
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParsePrefixMap(t *testing.T) {
+	tests := []struct {
+		s       string
+		want    map[string]string
+		wantErr string
+	}{
+		{s: "", want: map[string]string{}},
+		{s: "prod=ECSProd", want: map[string]string{"prod": "ECSProd"}},
+		{s: "prod=ECSProd, staging/web=ECSStagingWeb", want: map[string]string{"prod": "ECSProd", "staging/web": "ECSStagingWeb"}},
+		{s: "prod", wantErr: "expected cluster[/service]=prefix"},
+		{s: "=ECSProd", wantErr: "expected cluster[/service]=prefix"},
+		{s: "/web=ECSWeb", wantErr: "expected cluster[/service]=prefix"},
+		{s: "prod/=ECSProd", wantErr: "expected cluster[/service]=prefix"},
+		{s: "prod/web/api=ECSProd", wantErr: "expected cluster[/service]=prefix"},
+		{s: "prod=", wantErr: "the prefix must be of [-a-zA-Z0-9_]"},
+		{s: "prod=ECS.Prod", wantErr: "the prefix must be of [-a-zA-Z0-9_]"},
+		{s: "prod=A,prod=B", wantErr: "duplicate prefix map of prod"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.s, func(t *testing.T) {
+			got, err := parsePrefixMap(tt.s)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("parsePrefixMap() error = %v, want %s", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parsePrefixMap() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSplitByPrefixMap(t *testing.T) {
+	type target struct {
+		prefix, cluster, service string
+	}
+	tests := []struct {
+		name      string
+		cluster   string
+		service   string
+		prefixMap map[string]string
+		want      []target
+		wantErr   string
+	}{
+		{
+			name:    "no prefix map",
+			cluster: "prod,staging",
+			want:    []target{{"ECS", "prod,staging", ""}},
+		},
+		{
+			name:      "clusters",
+			cluster:   "prod,staging,dev",
+			prefixMap: map[string]string{"prod": "ECSProd", "staging": "ECSStaging"},
+			want: []target{
+				{"ECSProd", "prod", ""},
+				{"ECSStaging", "staging", ""},
+				{"ECS", "dev", ""},
+			},
+		},
+		{
+			name:      "clusters of the same prefix",
+			cluster:   "prod,staging,dev",
+			prefixMap: map[string]string{"prod": "ECSProd", "dev": "ECSProd"},
+			want: []target{
+				{"ECSProd", "prod,dev", ""},
+				{"ECS", "staging", ""},
+			},
+		},
+		{
+			name:      "a single cluster",
+			cluster:   "prod",
+			prefixMap: map[string]string{"prod": "ECSProd"},
+			want:      []target{{"ECSProd", "prod", ""}},
+		},
+		{
+			name:      "services",
+			cluster:   "prod",
+			service:   "web,worker,batch",
+			prefixMap: map[string]string{"prod/web": "ECSWeb"},
+			want: []target{
+				{"ECSWeb", "prod", "web"},
+				{"ECS", "prod", "worker,batch"},
+			},
+		},
+		{
+			name:      "services falling back to the cluster",
+			cluster:   "prod",
+			service:   "web,worker,batch",
+			prefixMap: map[string]string{"prod/web": "ECSWeb", "prod": "ECSProd"},
+			want: []target{
+				{"ECSWeb", "prod", "web"},
+				{"ECSProd", "prod", "worker,batch"},
+			},
+		},
+		{
+			name:      "unknown cluster",
+			cluster:   "prod,staging",
+			prefixMap: map[string]string{"dev": "ECSDev"},
+			wantErr:   "prefix-map of dev matches no cluster or service",
+		},
+		{
+			name:      "unknown service",
+			cluster:   "prod",
+			service:   "web,worker",
+			prefixMap: map[string]string{"prod/api": "ECSApi"},
+			wantErr:   "prefix-map of prod/api matches no cluster or service",
+		},
+		{
+			name:      "service of the clusters",
+			cluster:   "prod,staging",
+			prefixMap: map[string]string{"prod/web": "ECSWeb"},
+			wantErr:   "prefix-map of prod/web matches no cluster or service",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newTestPlugin(t, nil, nil)
+			p.ClusterName = tt.cluster
+			p.ServiceName = tt.service
+			p.PrefixMap = tt.prefixMap
+			plugins, err := p.splitByPrefixMap()
+			if tt.wantErr != "" {
+				if err == nil || !strings.HasPrefix(err.Error(), tt.wantErr) {
+					t.Fatalf("splitByPrefixMap() error = %v, want %s", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []target
+			for _, sp := range plugins {
+				if sp.PrefixMap != nil {
+					t.Errorf("%s has the prefix map", sp.MetricKeyPrefix())
+				}
+				got = append(got, target{sp.MetricKeyPrefix(), sp.ClusterName, sp.ServiceName})
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("splitByPrefixMap() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSplitByPrefixMapInvalidOptions(t *testing.T) {
+	p := newTestPlugin(t, nil, nil)
+	p.ServiceName = "web,worker"
+	p.TopN = 1
+	p.PrefixMap = map[string]string{"test/web": "ECSWeb"}
+	// each of the services alone is not multiple services of top-n
+	if _, err := p.splitByPrefixMap(); err == nil || !strings.Contains(err.Error(), "top-n requires") {
+		t.Errorf("splitByPrefixMap() error = %v, want the one of top-n", err)
+	}
+}
+
+func TestCheckUniquePrefixes(t *testing.T) {
+	if err := checkUniquePrefixes([]ECSPlugin{{Prefix: "ECSProd"}, {Prefix: "ECS"}}); err != nil {
+		t.Errorf("checkUniquePrefixes() = %v, want nil", err)
+	}
+	// the default prefix is ECS
+	if err := checkUniquePrefixes([]ECSPlugin{{Prefix: "ECSProd"}, {}, {Prefix: "ECS"}}); err == nil {
+		t.Errorf("checkUniquePrefixes() = nil, want an error of ECS")
+	}
+}
@@ -0,0 +1,111 @@
+package mpawsecs
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+var prometheusNameSanitizeReg = regexp.MustCompile(`[^a-zA-Z0-9_:]`)
+
+// prometheusName maps a Mackerel metric key such as "ECS.CPUUtilization.CPUUtilizationAverage"
+// into a Prometheus metric name such as "ECS_CPUUtilization_CPUUtilizationAverage".
+func prometheusName(key string) string {
+	return prometheusNameSanitizeReg.ReplaceAllString(key, "_")
+}
+
+// writePrometheus fetches the metrics and writes them in the Prometheus text exposition format
+// with the cluster and service as labels. The metrics of each of multiple clusters or services
+// share the same names and are told apart by the cluster or service label.
+func (p ECSPlugin) writePrometheus(w io.Writer) error {
+	stat, err := p.FetchMetrics()
+	if err != nil {
+		return err
+	}
+
+	targetNames, targets := p.targets()
+	prefix := p.MetricKeyPrefix() + "."
+
+	// name -> labels -> value
+	samples := make(map[string]map[string]float64)
+	for key, v := range p.metricValues(stat) {
+		// the metrics not nested under a cluster or service are labeled with p itself
+		t := p
+		if p.nested() {
+			for i, name := range targetNames {
+				if rest := strings.TrimPrefix(key, prefix+name+"."); rest != key {
+					key = prefix + rest
+					t = targets[i]
+					break
+				}
+			}
+		}
+		var labels []string
+		if len(t.clusterNames()) == 1 {
+			labels = append(labels, fmt.Sprintf("cluster=%s", strconv.Quote(t.ClusterName)))
+		}
+		if services := t.serviceNames(); len(services) == 1 {
+			labels = append(labels, fmt.Sprintf("service=%s", strconv.Quote(services[0])))
+		}
+		name := prometheusName(key)
+		if samples[name] == nil {
+			samples[name] = make(map[string]float64)
+		}
+		samples[name][strings.Join(labels, ",")] = v
+	}
+
+	names := make([]string, 0, len(samples))
+	for name := range samples {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if _, err := fmt.Fprintf(w, "# TYPE %s gauge\n", name); err != nil {
+			return err
+		}
+		for _, labels := range sortedKeys(samples[name]) {
+			if _, err := fmt.Fprintf(w, "%s{%s} %s\n", name, labels, strconv.FormatFloat(samples[name][labels], 'g', -1, 64)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// servePrometheusOnce serves /metrics at addr for a single scrape and then returns.
+func (p ECSPlugin) servePrometheusOnce(addr string) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	scraped := make(chan struct{})
+	var once sync.Once
+	srv := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != "/metrics" {
+				http.NotFound(w, r)
+				return
+			}
+			w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+			if err := p.writePrometheus(w); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+			}
+			once.Do(func() { close(scraped) })
+		}),
+	}
+	go srv.Serve(ln)
+
+	select {
+	case <-scraped:
+	case <-p.context().Done():
+	}
+	return srv.Shutdown(context.Background())
+}
@@ -0,0 +1,53 @@
+package mpawsecs
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/mackerelio/golib/pluginutil"
+)
+
+// registryFilename is the host-local registry of the running plugin instances,
+// placed under MACKEREL_PLUGIN_WORKDIR (or the temp dir).
+const registryFilename = "mackerel-plugin-aws-ecs-registry.json"
+
+// An instance which has not run for registryTTL is no longer regarded as running.
+const registryTTL = 10 * time.Minute
+
+type registryEntry struct {
+	Args     string    `json:"args"`
+	LastSeen time.Time `json:"last_seen"`
+}
+
+func registryPath() string {
+	return filepath.Join(pluginutil.PluginWorkDir(), registryFilename)
+}
+
+// checkPrefixCollision registers this instance by prefix+cluster+service,
+// and returns an error when another instance started with different options
+// is already registered with the same combination.
+func (p ECSPlugin) checkPrefixCollision() error {
+	key := strings.Join([]string{p.MetricKeyPrefix(), p.ClusterName, p.ServiceName}, "/")
+	args := fmt.Sprintf("%x", sha1.Sum([]byte(strings.Join(os.Args[1:], " "))))
+	now := time.Now()
+
+	path := registryPath()
+	registry := make(map[string]registryEntry)
+	if err := loadState(path, &registry); err != nil {
+		return fmt.Errorf("failed to load the registry %s: %s", path, err)
+	}
+	if e, ok := registry[key]; ok && e.Args != args && now.Sub(e.LastSeen) < registryTTL {
+		return fmt.Errorf("metric key prefix %q for cluster %q and service %q is already used by another plugin instance (see %s)", p.MetricKeyPrefix(), p.ClusterName, p.ServiceName, path)
+	}
+	registry[key] = registryEntry{Args: args, LastSeen: now}
+	for k, e := range registry {
+		if now.Sub(e.LastSeen) >= registryTTL {
+			delete(registry, k)
+		}
+	}
+	return saveState(path, registry)
+}
@@ -0,0 +1,106 @@
+package mpawsecs
+
+import (
+	"fmt"
+	"log"
+	"regexp"
+	"strconv"
+	"strings"
+
+	mp "github.com/mackerelio/go-mackerel-plugin"
+)
+
+// Bounds is the range of sane values of a graph
+type Bounds struct {
+	Min float64
+	Max float64
+}
+
+var percentageBounds = Bounds{Min: 0, Max: 100}
+
+// parseSanityBounds parses comma separated bounds such as "CPUUtilization=0:400,Task=0:1000"
+func parseSanityBounds(s string) (map[string]Bounds, error) {
+	sanityBounds := make(map[string]Bounds)
+	if s == "" {
+		return sanityBounds, nil
+	}
+	for _, entry := range strings.Split(s, ",") {
+		kv := strings.SplitN(strings.TrimSpace(entry), "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			return nil, fmt.Errorf("invalid sanity bounds %q: expected graph=min:max", entry)
+		}
+		minMax := strings.SplitN(kv[1], ":", 2)
+		if len(minMax) != 2 {
+			return nil, fmt.Errorf("invalid sanity bounds %q: expected graph=min:max", entry)
+		}
+		min, err := strconv.ParseFloat(minMax[0], 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid sanity bounds %q: %s", entry, err)
+		}
+		max, err := strconv.ParseFloat(minMax[1], 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid sanity bounds %q: %s", entry, err)
+		}
+		if min > max {
+			return nil, fmt.Errorf("invalid sanity bounds %q: min is greater than max", entry)
+		}
+		sanityBounds[kv[0]] = Bounds{Min: min, Max: max}
+	}
+	return sanityBounds, nil
+}
+
+// graphStatKeys returns the keys of stat which are emitted as the metric of the graph.
+func graphStatKeys(key string, metric mp.Metrics, stat map[string]float64) []string {
+	if !strings.ContainsAny(key+metric.Name, "*#") {
+		if _, ok := stat[metric.Name]; ok {
+			return []string{metric.Name}
+		}
+		return nil
+	}
+	// same matching as go-mackerel-plugin does for wildcard metrics
+	regexpStr := `\A` + key + "." + metric.Name
+	regexpStr = strings.Replace(regexpStr, ".", `\.`, -1)
+	regexpStr = strings.Replace(regexpStr, "*", `[-a-zA-Z0-9_]+`, -1)
+	regexpStr = strings.Replace(regexpStr, "#", `[-a-zA-Z0-9_]+`, -1)
+	re := regexp.MustCompile(regexpStr)
+	var keys []string
+	for k := range stat {
+		if re.MatchString(k) {
+			keys = append(keys, k)
+		}
+	}
+	return keys
+}
+
+// isCountingStatistic reports whether the metric is of the SampleCount or Sum statistic
+func isCountingStatistic(name string) bool {
+	return strings.HasSuffix(name, metricsTypeSampleCount) || strings.HasSuffix(name, metricsTypeSum)
+}
+
+// dropInsaneValues removes the values out of the bounds of their graph.
+// Percentage graphs are bounded to 0-100 unless overridden, except for their SampleCount
+// and Sum statistics.
+func (p ECSPlugin) dropInsaneValues(stat map[string]float64) {
+	for key, graph := range p.GraphDefinition() {
+		// the bounds of a graph apply to the graph of every cluster or service
+		bounds, ok := p.SanityBounds[strings.TrimPrefix(key, targetWildcard)]
+		if !ok {
+			if graph.Unit != "percentage" {
+				continue
+			}
+			bounds = percentageBounds
+		}
+		for _, metric := range graph.Metrics {
+			// SampleCount counts the tasks and Sum adds up their percentages, both beyond 100
+			if !ok && isCountingStatistic(metric.Name) {
+				continue
+			}
+			for _, k := range graphStatKeys(key, metric, stat) {
+				if v := stat[k]; v < bounds.Min || v > bounds.Max {
+					log.Printf("%s: value %f is out of bounds [%f, %f], dropped", k, v, bounds.Min, bounds.Max)
+					delete(stat, k)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,156 @@
+package mpawsecs
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/service/ecs"
+)
+
+func TestParseSanityBounds(t *testing.T) {
+	tests := []struct {
+		s       string
+		want    map[string]Bounds
+		wantErr bool
+	}{
+		{s: "", want: map[string]Bounds{}},
+		{s: "CPUUtilization=0:400", want: map[string]Bounds{"CPUUtilization": {0, 400}}},
+		{s: "CPUUtilization=0:400, Task=0:1000", want: map[string]Bounds{"CPUUtilization": {0, 400}, "Task": {0, 1000}}},
+		{s: "Task=-1.5:2.5", want: map[string]Bounds{"Task": {-1.5, 2.5}}},
+		{s: "CPUUtilization", wantErr: true},
+		{s: "=0:100", wantErr: true},
+		{s: "CPUUtilization=100", wantErr: true},
+		{s: "CPUUtilization=low:100", wantErr: true},
+		{s: "CPUUtilization=100:0", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.s, func(t *testing.T) {
+			got, err := parseSanityBounds(tt.s)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseSanityBounds() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseSanityBounds() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDropInsaneValues(t *testing.T) {
+	stat := map[string]float64{
+		"CPUUtilizationAverage":    50,
+		"CPUUtilizationMinimum":    0,
+		"CPUUtilizationMaximum":    100,
+		"MemoryUtilizationAverage": 100.5,
+		"MemoryUtilizationMinimum": -1,
+		"TaskRunning":              1e9,
+	}
+
+	tests := []struct {
+		name   string
+		bounds map[string]Bounds
+		want   map[string]float64
+	}{
+		{
+			name: "percentage graphs by default",
+			want: map[string]float64{
+				"CPUUtilizationAverage": 50,
+				"CPUUtilizationMinimum": 0,
+				"CPUUtilizationMaximum": 100,
+				"TaskRunning":           1e9,
+			},
+		},
+		{
+			name: "overridden bounds",
+			bounds: map[string]Bounds{
+				"CPUUtilization": {0, 60},
+				"Task":           {0, 1000},
+			},
+			want: map[string]float64{
+				"CPUUtilizationAverage": 50,
+				"CPUUtilizationMinimum": 0,
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := ECSPlugin{ServiceName: "web", TaskCountSource: taskCountECS, SanityCheck: true, SanityBounds: tt.bounds}
+			got := make(map[string]float64)
+			for k, v := range stat {
+				got[k] = v
+			}
+			p.dropInsaneValues(got)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("dropInsaneValues() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDropInsaneValuesOfServices(t *testing.T) {
+	p := ECSPlugin{ServiceName: "web,worker", TaskCountSource: taskCountECS, SanityBounds: map[string]Bounds{"Task": {0, 10}}}
+	stat := map[string]float64{
+		"web.CPUUtilization.CPUUtilizationAverage":    20,
+		"worker.CPUUtilization.CPUUtilizationAverage": 250,
+		"web.Task.TaskRunning":                        2,
+		"worker.Task.TaskRunning":                     11,
+	}
+	p.dropInsaneValues(stat)
+	want := map[string]float64{
+		"web.CPUUtilization.CPUUtilizationAverage": 20,
+		"web.Task.TaskRunning":                     2,
+	}
+	if !reflect.DeepEqual(stat, want) {
+		t.Errorf("dropInsaneValues() = %v, want %v", stat, want)
+	}
+}
+
+func TestDropInsaneValuesOfCountingStatistics(t *testing.T) {
+	// 150 tasks of the service
+	cw := &fakeCloudWatch{points: map[string][]point{
+		"web CPUUtilization Average":        minutesAgo(40, 40),
+		"web CPUUtilization SampleCount":    minutesAgo(150, 150),
+		"web CPUUtilization Sum":            minutesAgo(6000, 6000),
+		"web MemoryUtilization Average":     minutesAgo(130, 130),
+		"web MemoryUtilization SampleCount": minutesAgo(150, 150),
+		"web MemoryUtilization Sum":         minutesAgo(19500, 19500),
+	}}
+	e := &fakeECS{services: map[string]*ecs.Service{"web": newService("web", 150, 0, 150)}}
+	p := newTestPlugin(t, cw, e)
+	p.ServiceName = "web"
+	p.Statistics = []string{metricsTypeAverage, metricsTypeSampleCount, metricsTypeSum}
+	p.SanityCheck = true
+
+	stat, err := p.FetchMetrics()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]float64{
+		"CPUUtilizationAverage":        40,
+		"CPUUtilizationSampleCount":    150,
+		"CPUUtilizationSum":            6000,
+		"MemoryUtilizationSampleCount": 150,
+		"MemoryUtilizationSum":         19500,
+	}
+	for key, v := range want {
+		if got, ok := stat[key]; !ok || got != v {
+			t.Errorf("%s = %v (reported: %v), want %v", key, got, ok, v)
+		}
+	}
+	// the Average is still bounded to 0-100
+	if v, ok := stat["MemoryUtilizationAverage"]; ok {
+		t.Errorf("MemoryUtilizationAverage = %v, want dropped", v)
+	}
+
+	// the bounds given to the graph apply to all of its statistics
+	p.SanityBounds = map[string]Bounds{"CPUUtilization": {0, 100}}
+	stat, err = p.FetchMetrics()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"CPUUtilizationSampleCount", "CPUUtilizationSum"} {
+		if v, ok := stat[key]; ok {
+			t.Errorf("%s = %v with the bounds of the graph, want dropped", key, v)
+		}
+	}
+}
@@ -0,0 +1,51 @@
+package mpawsecs
+
+import (
+	"crypto/sha1"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/mackerelio/golib/pluginutil"
+)
+
+// stateFile returns the path of a state file kept between runs.
+// Like the tempfile of go-mackerel-plugin, it is distinguished by the
+// command-line options so that plugin instances don't share their state.
+func (p ECSPlugin) stateFile(name string) string {
+	filename := fmt.Sprintf(
+		"mackerel-plugin-aws-ecs-%s-%s-%x",
+		name,
+		p.MetricKeyPrefix(),
+		sha1.Sum([]byte(strings.Join(os.Args[1:], " "))),
+	)
+	return filepath.Join(pluginutil.PluginWorkDir(), filename)
+}
+
+// loadState decodes the state file into v. A missing file is not an error.
+func loadState(path string, v interface{}) error {
+	f, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	defer f.Close()
+	return json.NewDecoder(f).Decode(v)
+}
+
+// saveState writes v to the state file atomically.
+func saveState(path string, v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, b, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
@@ -0,0 +1,119 @@
+package mpawsecs
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws/session"
+)
+
+func TestStateFile(t *testing.T) {
+	// e.g. C:\ProgramData\Mackerel Agent of mackerel-agent on Windows, with a space
+	dir := filepath.Join(t.TempDir(), "Mackerel Agent")
+	if err := os.Mkdir(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("work dir", func(t *testing.T) {
+		t.Setenv("MACKEREL_PLUGIN_WORKDIR", dir)
+		path := ECSPlugin{}.stateFile("emitted")
+		if filepath.Dir(path) != dir {
+			t.Errorf("stateFile() = %s, want in %s", path, dir)
+		}
+		// the characters which can't be in a file name on Windows
+		if name := filepath.Base(path); strings.ContainsAny(name, `<>:"/\|?*`) {
+			t.Errorf("stateFile() = %s, want a file name valid on Windows", name)
+		}
+	})
+	t.Run("temp dir", func(t *testing.T) {
+		t.Setenv("MACKEREL_PLUGIN_WORKDIR", "")
+		if path := (ECSPlugin{}).stateFile("emitted"); filepath.Dir(path) != os.TempDir() {
+			t.Errorf("stateFile() = %s, want in %s", path, os.TempDir())
+		}
+	})
+	t.Run("distinguished", func(t *testing.T) {
+		t.Setenv("MACKEREL_PLUGIN_WORKDIR", dir)
+		p := ECSPlugin{}
+		if p.stateFile("emitted") == p.stateFile("datapoint-times") {
+			t.Error("the state files of different names are the same")
+		}
+		if p.stateFile("emitted") == (ECSPlugin{Prefix: "web"}).stateFile("emitted") {
+			t.Error("the state files of different prefixes are the same")
+		}
+	})
+}
+
+func TestSaveState(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "Mackerel Agent", "state")
+	if err := os.Mkdir(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	var missing map[string]float64
+	if err := loadState(path, &missing); err != nil || missing != nil {
+		t.Errorf("loadState() of a missing file = %v, %v, want nothing", missing, err)
+	}
+	// the second save replaces the file, which os.Rename has to do on Windows too
+	for _, want := range []map[string]float64{{"TaskRunning": 1}, {"TaskRunning": 2}} {
+		if err := saveState(path, want); err != nil {
+			t.Fatal(err)
+		}
+		var got map[string]float64
+		if err := loadState(path, &got); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("loadState() = %v, want %v", got, want)
+		}
+	}
+	if _, err := os.Stat(path + ".tmp"); !os.IsNotExist(err) {
+		t.Errorf("the temporary file is left: %v", err)
+	}
+}
+
+func TestSharedConfigFiles(t *testing.T) {
+	if files := (ECSPlugin{}).sharedConfigFiles(); files != nil {
+		t.Errorf("sharedConfigFiles() = %v, want nil for the files of the SDK", files)
+	}
+
+	// e.g. C:\Users\mackerel\.aws\credentials, which a Windows service doesn't find
+	path := filepath.Join(t.TempDir(), ".aws", "credentials")
+	if err := os.Mkdir(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	content := "[prod]\r\naws_access_key_id = AKIAEXAMPLEPROD\r\naws_secret_access_key = secret\r\nregion = eu-west-1\r\n"
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	for _, env := range []string{"AWS_ACCESS_KEY_ID", "AWS_SECRET_ACCESS_KEY", "AWS_SESSION_TOKEN", "AWS_PROFILE", "AWS_REGION"} {
+		t.Setenv(env, "")
+	}
+	t.Setenv("AWS_SHARED_CREDENTIALS_FILE", filepath.Join(t.TempDir(), "missing"))
+	t.Setenv("AWS_CONFIG_FILE", filepath.Join(t.TempDir(), "missing"))
+
+	p := ECSPlugin{Profile: "prod", SharedCredentialsFile: path}
+	if files := p.sharedConfigFiles(); !reflect.DeepEqual(files, []string{path}) {
+		t.Errorf("sharedConfigFiles() = %v, want [%s]", files, path)
+	}
+	sess, err := session.NewSessionWithOptions(session.Options{
+		Profile:           p.Profile,
+		SharedConfigState: p.sharedConfigState(),
+		SharedConfigFiles: p.sharedConfigFiles(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	creds, err := sess.Config.Credentials.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if creds.AccessKeyID != "AKIAEXAMPLEPROD" {
+		t.Errorf("AccessKeyID = %s, want the one of the profile", creds.AccessKeyID)
+	}
+	if region := *sess.Config.Region; region != "eu-west-1" {
+		t.Errorf("Region = %s, want the one of the profile", region)
+	}
+}
@@ -0,0 +1,87 @@
+package mpawsecs
+
+import (
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+	"github.com/aws/aws-sdk-go/service/elbv2"
+)
+
+// target health metrics of the load balancer, keyed by the stat name
+var targetHealthMetrics = map[string]string{
+	"TargetGroupHealthy":   "HealthyHostCount",
+	"TargetGroupUnhealthy": "UnHealthyHostCount",
+}
+
+type targetGroup struct {
+	namespace  string
+	dimensions []*cloudwatch.Dimension
+}
+
+// arnResource returns the resource part of an ARN after the given type,
+// e.g. "targetgroup/my-targets/73e2d6bc24d8a067" for "targetgroup/".
+func arnResource(arn, resourceType string) (string, error) {
+	i := strings.Index(arn, ":"+resourceType)
+	if i < 0 {
+		return "", fmt.Errorf("unexpected ARN: %s", arn)
+	}
+	return arn[i+1:], nil
+}
+
+// resolveTargetGroup looks up the load balancer of the target group
+// and builds the dimensions its CloudWatch metrics are published with.
+func (p ECSPlugin) resolveTargetGroup() (*targetGroup, error) {
+	out, err := p.ELBV2.DescribeTargetGroupsWithContext(p.context(), &elbv2.DescribeTargetGroupsInput{
+		TargetGroupArns: aws.StringSlice([]string{p.TargetGroupARN}),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to describe the target group: %s", err)
+	}
+	if len(out.TargetGroups) == 0 || len(out.TargetGroups[0].LoadBalancerArns) == 0 {
+		return nil, fmt.Errorf("target group %s is not attached to any load balancer", p.TargetGroupARN)
+	}
+	lbArns := aws.StringValueSlice(out.TargetGroups[0].LoadBalancerArns)
+	if len(lbArns) > 1 {
+		log.Printf("target group %s is attached to %d load balancers, using %s", p.TargetGroupARN, len(lbArns), lbArns[0])
+	}
+
+	tg, err := arnResource(p.TargetGroupARN, "targetgroup/")
+	if err != nil {
+		return nil, err
+	}
+	// "loadbalancer/app/my-lb/50dc6c495c0c9188" is published as "app/my-lb/50dc6c495c0c9188"
+	lb, err := arnResource(lbArns[0], "loadbalancer/")
+	if err != nil {
+		return nil, err
+	}
+	lb = strings.TrimPrefix(lb, "loadbalancer/")
+
+	namespace := "AWS/ApplicationELB"
+	if strings.HasPrefix(lb, "net/") {
+		namespace = "AWS/NetworkELB"
+	}
+	return &targetGroup{
+		namespace: namespace,
+		dimensions: []*cloudwatch.Dimension{
+			{Name: aws.String("TargetGroup"), Value: aws.String(tg)},
+			{Name: aws.String("LoadBalancer"), Value: aws.String(lb)},
+		},
+	}, nil
+}
+
+func (p ECSPlugin) addTargetHealth(b *batch, stat map[string]float64) {
+	for key, name := range targetHealthMetrics {
+		key, met := key, metrics{name, metricsTypeAverage}
+		b.add(query{p.targetGroup.namespace, p.targetGroup.dimensions, met}, func(s series, err error) {
+			if err != nil {
+				p.logQueryError(fmt.Sprint(met), err)
+				p.markMissing(stat, key, err)
+				return
+			}
+			p.setPoint(stat, key, s)
+		})
+	}
+}
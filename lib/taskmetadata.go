@@ -0,0 +1,253 @@
+package mpawsecs
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	mp "github.com/mackerelio/go-mackerel-plugin"
+)
+
+// the sources of the metrics
+const (
+	sourceCloudWatch = "cloudwatch"
+	sourceMetadata   = "metadata"
+)
+
+// taskMetadataEnv is set by the ECS agent in every container of a task
+// https://docs.aws.amazon.com/AmazonECS/latest/developerguide/task-metadata-endpoint-v4.html
+const taskMetadataEnv = "ECS_CONTAINER_METADATA_URI_V4"
+
+type taskMetadata struct {
+	Cluster    string `json:"Cluster"`
+	TaskARN    string `json:"TaskARN"`
+	Containers []struct {
+		DockerID string `json:"DockerId"`
+		Name     string `json:"Name"`
+	} `json:"Containers"`
+}
+
+type cpuStats struct {
+	CPUUsage struct {
+		TotalUsage uint64 `json:"total_usage"`
+	} `json:"cpu_usage"`
+	SystemCPUUsage uint64 `json:"system_cpu_usage"`
+}
+
+// containerStats is the subset of the Docker stats of a container which the endpoint returns
+type containerStats struct {
+	Read        time.Time `json:"read"`
+	CPUStats    cpuStats  `json:"cpu_stats"`
+	PreCPUStats cpuStats  `json:"precpu_stats"`
+	MemoryStats struct {
+		Usage uint64            `json:"usage"`
+		Limit uint64            `json:"limit"`
+		Stats map[string]uint64 `json:"stats"`
+	} `json:"memory_stats"`
+	Networks map[string]struct {
+		RxBytes uint64 `json:"rx_bytes"`
+		TxBytes uint64 `json:"tx_bytes"`
+	} `json:"networks"`
+	BlkioStats struct {
+		IOServiceBytesRecursive []struct {
+			Op    string `json:"op"`
+			Value uint64 `json:"value"`
+		} `json:"io_service_bytes_recursive"`
+	} `json:"blkio_stats"`
+}
+
+// cpuPercent is the CPU usage since the previous stats in percent of all the CPUs of the host
+// (or of the Fargate task), like CPUUtilization of CloudWatch
+func (s containerStats) cpuPercent() (float64, bool) {
+	cpuDelta := float64(s.CPUStats.CPUUsage.TotalUsage) - float64(s.PreCPUStats.CPUUsage.TotalUsage)
+	systemDelta := float64(s.CPUStats.SystemCPUUsage) - float64(s.PreCPUStats.SystemCPUUsage)
+	if cpuDelta < 0 || systemDelta <= 0 {
+		return 0, false
+	}
+	return cpuDelta / systemDelta * 100, true
+}
+
+// memoryUsage excludes the page cache, as docker stats does
+func (s containerStats) memoryUsage() float64 {
+	usage := s.MemoryStats.Usage
+	// "cache" of cgroup v1, or "inactive_file" of cgroup v2
+	cache, ok := s.MemoryStats.Stats["cache"]
+	if !ok {
+		cache = s.MemoryStats.Stats["inactive_file"]
+	}
+	if cache < usage {
+		usage -= cache
+	}
+	return float64(usage)
+}
+
+// taskMetadataURI returns the Task Metadata Endpoint v4 of the task the plugin runs in
+func taskMetadataURI() (string, error) {
+	uri := os.Getenv(taskMetadataEnv)
+	if uri == "" {
+		return "", fmt.Errorf("%s is not set, -source metadata must run in an ECS task", taskMetadataEnv)
+	}
+	return uri, nil
+}
+
+func (p ECSPlugin) getTaskMetadata(path string, v interface{}) error {
+	uri, err := taskMetadataURI()
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(p.context(), http.MethodGet, uri+path, nil)
+	if err != nil {
+		return err
+	}
+	// the endpoint is link-local, so it is requested without the proxy
+	client := &http.Client{Timeout: p.Timeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s%s: %s", uri, path, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// counterState is the byte counters of the last run, to compute their rates
+type counterState struct {
+	Time     time.Time          `json:"time"`
+	Counters map[string]float64 `json:"counters"`
+}
+
+// counterRates reports the per second rates of the counters since the last run into stat.
+// The first run and the counters which were reset (e.g. by a restarted container) report nothing.
+func (p ECSPlugin) counterRates(stat map[string]float64, counters map[string]float64, now time.Time) {
+	path := p.stateFile("counters")
+	var last counterState
+	if err := loadState(path, &last); err != nil {
+		log.Printf("failed to load the last counters (ignore): %s", err)
+	}
+	if elapsed := now.Sub(last.Time).Seconds(); elapsed > 0 {
+		for key, v := range counters {
+			if prev, ok := last.Counters[key]; ok && v >= prev {
+				stat[key] = (v - prev) / elapsed
+			}
+		}
+	}
+	if err := saveState(path, counterState{Time: now, Counters: counters}); err != nil {
+		log.Printf("failed to save the counters: %s", err)
+	}
+}
+
+// fetchTaskMetadata reports the metrics of each container of the task from the Task Metadata
+// Endpoint, keyed by the container name, without calling any AWS API.
+func (p ECSPlugin) fetchTaskMetadata(stat map[string]float64) error {
+	var task taskMetadata
+	if err := p.getTaskMetadata("/task", &task); err != nil {
+		return fmt.Errorf("failed to get the task metadata: %s", err)
+	}
+	var stats map[string]*containerStats
+	if err := p.getTaskMetadata("/task/stats", &stats); err != nil {
+		return fmt.Errorf("failed to get the task stats: %s", err)
+	}
+
+	now := time.Now()
+	counters := make(map[string]float64)
+	for _, c := range task.Containers {
+		s := stats[c.DockerID]
+		// a stopped container has no stats
+		if s == nil {
+			continue
+		}
+		key := sanitizeMetricKey(c.Name)
+		if cpu, ok := s.cpuPercent(); ok {
+			stat["TaskContainerCPU."+key+".Usage"] = cpu
+		}
+		stat["TaskContainerMemory."+key+".Usage"] = s.memoryUsage()
+		stat["TaskContainerMemory."+key+".Limit"] = float64(s.MemoryStats.Limit)
+
+		var rx, tx float64
+		for _, n := range s.Networks {
+			rx += float64(n.RxBytes)
+			tx += float64(n.TxBytes)
+		}
+		// the containers of the host network mode have no networks
+		if len(s.Networks) > 0 {
+			counters["TaskContainerNetwork."+key+".RxBytes"] = rx
+			counters["TaskContainerNetwork."+key+".TxBytes"] = tx
+		}
+		var read, write float64
+		for _, io := range s.BlkioStats.IOServiceBytesRecursive {
+			switch io.Op {
+			case "Read", "read":
+				read += float64(io.Value)
+			case "Write", "write":
+				write += float64(io.Value)
+			}
+		}
+		counters["TaskContainerBlockIO."+key+".ReadBytes"] = read
+		counters["TaskContainerBlockIO."+key+".WriteBytes"] = write
+	}
+	p.counterRates(stat, counters, now)
+	return nil
+}
+
+// prepareTaskMetadata checks that the plugin runs in a task, and takes the cluster
+// from the task metadata unless given
+func (p *ECSPlugin) prepareTaskMetadata() error {
+	if _, err := taskMetadataURI(); err != nil {
+		return err
+	}
+	if p.ClusterName != "" {
+		return nil
+	}
+	var task taskMetadata
+	if err := p.getTaskMetadata("/task", &task); err != nil {
+		return fmt.Errorf("failed to get the task metadata: %s", err)
+	}
+	if task.Cluster == "" {
+		return errors.New("no cluster in the task metadata")
+	}
+	p.ClusterName = task.Cluster
+	return nil
+}
+
+func (p ECSPlugin) taskMetadataGraphDefinition() map[string]mp.Graphs {
+	labelPrefix := p.labelPrefix()
+	return map[string]mp.Graphs{
+		"TaskContainerCPU.#": {
+			Label: labelPrefix + " Container CPU",
+			Unit:  "percentage",
+			Metrics: []mp.Metrics{
+				{Name: "Usage", Label: "%1"},
+			},
+		},
+		"TaskContainerMemory.#": {
+			Label: labelPrefix + " Container Memory",
+			Unit:  "bytes",
+			Metrics: []mp.Metrics{
+				{Name: "Usage", Label: "%1 Usage"},
+				{Name: "Limit", Label: "%1 Limit"},
+			},
+		},
+		"TaskContainerNetwork.#": {
+			Label: labelPrefix + " Container Network",
+			Unit:  "bytes/sec",
+			Metrics: []mp.Metrics{
+				{Name: "RxBytes", Label: "%1 Rx"},
+				{Name: "TxBytes", Label: "%1 Tx"},
+			},
+		},
+		"TaskContainerBlockIO.#": {
+			Label: labelPrefix + " Container Block I/O",
+			Unit:  "bytes/sec",
+			Metrics: []mp.Metrics{
+				{Name: "ReadBytes", Label: "%1 Read"},
+				{Name: "WriteBytes", Label: "%1 Write"},
+			},
+		},
+	}
+}
@@ -0,0 +1,244 @@
+package mpawsecs
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/applicationautoscaling"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+	"github.com/aws/aws-sdk-go/service/ecs"
+	"github.com/aws/aws-sdk-go/service/sts"
+)
+
+// check is a result of -validate
+type check struct {
+	name string
+	// what was found, on success
+	detail string
+	err    error
+}
+
+// the error codes of AWS which mean a missing IAM permission or invalid credentials
+var (
+	accessDeniedCodes = map[string]bool{
+		"AccessDenied":          true,
+		"AccessDeniedException": true,
+		"UnauthorizedOperation": true,
+	}
+	invalidCredentialsCodes = map[string]bool{
+		"InvalidClientTokenId":        true,
+		"UnrecognizedClientException": true,
+		"SignatureDoesNotMatch":       true,
+		"ExpiredToken":                true,
+		"ExpiredTokenException":       true,
+		"NoCredentialProviders":       true,
+	}
+)
+
+// hint tells what to do about the error of the AWS API action
+func hint(action string, err error) string {
+	var aerr awserr.Error
+	if !errors.As(err, &aerr) {
+		return ""
+	}
+	switch {
+	case accessDeniedCodes[aerr.Code()]:
+		return fmt.Sprintf("grant %s to the IAM user or role of the credentials", action)
+	case invalidCredentialsCodes[aerr.Code()]:
+		return "check the access key, the profile or the role of the credentials"
+	}
+	return ""
+}
+
+// validate checks the credentials, the region, the clusters and services, and the IAM
+// permissions of the AWS API actions that the options require, and writes the report to w.
+// It reports whether all checks passed.
+func (p ECSPlugin) validate(w io.Writer) bool {
+	var checks []check
+	if p.Source == sourceMetadata {
+		var task taskMetadata
+		err := p.getTaskMetadata("/task", &task)
+		checks = append(checks, check{"task metadata endpoint", task.TaskARN, err})
+	} else {
+		checks = p.awsChecks()
+	}
+
+	ok := true
+	for _, c := range checks {
+		if c.err != nil {
+			ok = false
+			fmt.Fprintf(w, "[FAIL] %s: %s\n", c.name, c.err)
+			// the checks of the AWS API are named after their action
+			if h := hint(strings.Fields(c.name)[0], c.err); h != "" {
+				fmt.Fprintf(w, "       %s\n", h)
+			}
+			continue
+		}
+		if c.detail != "" {
+			fmt.Fprintf(w, "[OK]   %s: %s\n", c.name, c.detail)
+		} else {
+			fmt.Fprintf(w, "[OK]   %s\n", c.name)
+		}
+	}
+	return ok
+}
+
+// checkStoppedTasks lists a stopped task of the service as -emit-task-events does,
+// and describes it if there is one
+func (p ECSPlugin) checkStoppedTasks(service string) []check {
+	out, err := p.ECS.ListTasksWithContext(p.context(), &ecs.ListTasksInput{
+		Cluster:       aws.String(p.ClusterName),
+		ServiceName:   aws.String(service),
+		DesiredStatus: aws.String(ecs.DesiredStatusStopped),
+		MaxResults:    aws.Int64(1),
+	})
+	if err != nil {
+		return []check{{name: "ecs:ListTasks", err: err}}
+	}
+	checks := []check{{name: "ecs:ListTasks", detail: "stopped tasks of " + service}}
+	if len(out.TaskArns) == 0 {
+		return checks
+	}
+	_, err = p.ECS.DescribeTasksWithContext(p.context(), &ecs.DescribeTasksInput{
+		Cluster: aws.String(p.ClusterName),
+		Tasks:   out.TaskArns,
+	})
+	return append(checks, check{name: "ecs:DescribeTasks", err: err})
+}
+
+// awsChecks makes a request of each AWS API action used with the options
+func (p ECSPlugin) awsChecks() []check {
+	ctx := p.context()
+	checks := []check{{name: "region", detail: p.Region}}
+
+	identity, err := p.STS.GetCallerIdentityWithContext(ctx, &sts.GetCallerIdentityInput{})
+	if err != nil {
+		// the other checks would fail for the same reason
+		return append(checks, check{name: "sts:GetCallerIdentity", err: err})
+	}
+	checks = append(checks, check{name: "credentials", detail: aws.StringValue(identity.Arn)})
+
+	if p.MetricStreamFile == "" {
+		checks = append(checks, p.checkDatapoints()...)
+	}
+	if p.EnableContainerLevel {
+		_, err := p.CloudWatch.ListMetricsWithContext(ctx, &cloudwatch.ListMetricsInput{
+			Namespace: aws.String(containerInsightsNamespace),
+		})
+		checks = append(checks, check{name: "cloudwatch:ListMetrics", err: err})
+	}
+
+	out, err := p.ECS.DescribeClustersWithContext(ctx, &ecs.DescribeClustersInput{
+		Clusters: aws.StringSlice(p.clusterNames()),
+	})
+	if err != nil {
+		checks = append(checks, check{name: "ecs:DescribeClusters", err: err})
+	} else {
+		for _, f := range out.Failures {
+			checks = append(checks, check{name: "cluster " + aws.StringValue(f.Arn), err: errors.New(strings.ToLower(aws.StringValue(f.Reason)))})
+		}
+		for _, c := range out.Clusters {
+			var err error
+			if aws.StringValue(c.Status) != "ACTIVE" {
+				err = fmt.Errorf("status is %s", aws.StringValue(c.Status))
+			}
+			checks = append(checks, check{"cluster " + aws.StringValue(c.ClusterName), aws.StringValue(c.Status), err})
+		}
+	}
+
+	if p.EmitClusterTotals || p.AllServices {
+		// the cache would hide a missing permission
+		listed, err := p.listServicesUncached()
+		checks = append(checks, check{name: "ecs:ListServices", detail: fmt.Sprintf("%d services", len(listed)), err: err})
+	}
+	services := p.serviceNames()
+	if len(services) > 0 && p.TaskCountSource != taskCountCloudWatch {
+		checks = append(checks, p.checkServices(services)...)
+	}
+	if p.EmitTaskEvents && len(services) > 0 {
+		checks = append(checks, p.checkStoppedTasks(services[0])...)
+	}
+	if p.WithContainerInstances {
+		_, err := p.ECS.ListContainerInstancesWithContext(ctx, &ecs.ListContainerInstancesInput{
+			Cluster: aws.String(p.ClusterName),
+		})
+		checks = append(checks, check{name: "ecs:ListContainerInstances", err: err})
+	}
+	if p.EmitCapacityProviders {
+		_, err := p.ECS.DescribeCapacityProvidersWithContext(ctx, &ecs.DescribeCapacityProvidersInput{})
+		checks = append(checks, check{name: "ecs:DescribeCapacityProviders", err: err})
+	}
+	if p.EmitAutoscaling {
+		_, err := p.AutoScaling.DescribeScalableTargetsWithContext(ctx, &applicationautoscaling.DescribeScalableTargetsInput{
+			ServiceNamespace: aws.String(applicationautoscaling.ServiceNamespaceEcs),
+		})
+		checks = append(checks, check{name: "application-autoscaling:DescribeScalableTargets", err: err})
+	}
+	if p.targetGroup != nil {
+		checks = append(checks, check{name: "target group", detail: p.TargetGroupARN})
+	}
+	return checks
+}
+
+// checkDatapoints queries CPUUtilization (or CpuUtilized of a task definition family) of each
+// target, which tells a missing permission from a wrong cluster or service that has no datapoints
+func (p ECSPlugin) checkDatapoints() []check {
+	probe := metrics{"CPUUtilization", metricsTypeAverage}
+	// AWS/ECS has no metrics per task definition family
+	if p.TaskDefinitionFamily != "" {
+		probe.Name = "CpuUtilized"
+	}
+	names, targets := p.targets()
+	window := queryWindow(p.Period, p.Lookback)
+	checks := make([]check, len(targets))
+	b := &batch{}
+	for i, t := range targets {
+		i, name := i, "cloudwatch:GetMetricData"
+		if names[i] != "" {
+			name += " " + names[i]
+		}
+		b.add(t.query(probe), func(s series, err error) {
+			checks[i] = check{name: name, err: err}
+			if err == nil {
+				checks[i].detail = fmt.Sprintf("%d datapoints of %s in the last %s", len(s.values), probe.Name, window)
+			} else if errors.Is(err, errNoDatapoints) {
+				checks[i].err = fmt.Errorf("no datapoints of %s in the last %s, check the cluster, the service and the region", probe.Name, window)
+			}
+		})
+	}
+	p.fetch(b)
+	return checks
+}
+
+// checkServices describes the services to check that they exist in the cluster
+func (p ECSPlugin) checkServices(names []string) []check {
+	var checks []check
+	for i := 0; i < len(names); i += describeServicesLimit {
+		end := i + describeServicesLimit
+		if end > len(names) {
+			end = len(names)
+		}
+		out, err := p.ECS.DescribeServicesWithContext(p.context(), &ecs.DescribeServicesInput{
+			Cluster:  aws.String(p.ClusterName),
+			Services: aws.StringSlice(names[i:end]),
+		})
+		if err != nil {
+			return append(checks, check{name: "ecs:DescribeServices", err: err})
+		}
+		for _, f := range out.Failures {
+			checks = append(checks, check{name: "service " + aws.StringValue(f.Arn), err: errors.New(strings.ToLower(aws.StringValue(f.Reason)))})
+		}
+		for _, s := range out.Services {
+			var err error
+			if aws.StringValue(s.Status) != "ACTIVE" {
+				err = fmt.Errorf("status is %s", aws.StringValue(s.Status))
+			}
+			checks = append(checks, check{"service " + aws.StringValue(s.ServiceName), aws.StringValue(s.Status), err})
+		}
+	}
+	return checks
+}
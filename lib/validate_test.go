@@ -0,0 +1,132 @@
+package mpawsecs
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/ecs"
+	"github.com/aws/aws-sdk-go/service/ecs/ecsiface"
+)
+
+func TestCheckDatapoints(t *testing.T) {
+	tests := []struct {
+		name    string
+		service string
+		family  string
+		points  map[string][]point
+		// the error of the check, or none
+		wantErr string
+	}{
+		{
+			name:    "service",
+			service: "web",
+			points:  map[string][]point{"web CPUUtilization Average": minutesAgo(10, 20)},
+		},
+		{
+			name:    "service without datapoints",
+			service: "web",
+			points:  map[string][]point{"CPUUtilization Average": minutesAgo(10, 20)},
+			wantErr: "no datapoints of CPUUtilization",
+		},
+		{
+			name:   "task definition family",
+			family: "batch",
+			points: map[string][]point{"CpuUtilized Average": minutesAgo(128)},
+		},
+		{
+			name:    "task definition family without datapoints",
+			family:  "batch",
+			points:  map[string][]point{"CPUUtilization Average": minutesAgo(10)},
+			wantErr: "no datapoints of CpuUtilized",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newTestPlugin(t, &fakeCloudWatch{points: tt.points}, nil)
+			p.ServiceName = tt.service
+			p.TaskDefinitionFamily = tt.family
+
+			checks := p.checkDatapoints()
+			if len(checks) != 1 {
+				t.Fatalf("checkDatapoints() = %v, want 1 check", checks)
+			}
+			err := checks[0].err
+			if tt.wantErr == "" && err != nil {
+				t.Errorf("err = %v, want none", err)
+			}
+			if tt.wantErr != "" && (err == nil || !strings.HasPrefix(err.Error(), tt.wantErr)) {
+				t.Errorf("err = %v, want %s", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// deniedECS denies ListTasks
+type deniedECS struct {
+	*fakeECS
+}
+
+func (c deniedECS) ListTasksWithContext(aws.Context, *ecs.ListTasksInput, ...request.Option) (*ecs.ListTasksOutput, error) {
+	return nil, awserr.New("AccessDeniedException", "User is not authorized to perform: ecs:ListTasks", nil)
+}
+
+func TestCheckStoppedTasks(t *testing.T) {
+	web := newService("web", 1, 0, 1)
+	tests := []struct {
+		name   string
+		ecs    ecsiface.ECSAPI
+		want   []string
+		output string
+	}{
+		{
+			name: "no stopped tasks",
+			ecs:  &fakeECS{services: map[string]*ecs.Service{"web": web}},
+			want: []string{"ecs:ListTasks"},
+		},
+		{
+			name: "stopped tasks",
+			ecs: &fakeECS{
+				services: map[string]*ecs.Service{"web": web},
+				stopped: map[string][]*ecs.Task{"web": {
+					stoppedTask("web-1", ecs.TaskStopCodeUserInitiated, time.Now()),
+					stoppedTask("web-2", ecs.TaskStopCodeUserInitiated, time.Now()),
+				}},
+			},
+			want: []string{"ecs:ListTasks", "ecs:DescribeTasks"},
+		},
+		{
+			name:   "denied",
+			ecs:    deniedECS{&fakeECS{services: map[string]*ecs.Service{"web": web}}},
+			want:   []string{"ecs:ListTasks"},
+			output: "grant ecs:ListTasks",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newTestPlugin(t, nil, nil)
+			p.ECS = tt.ecs
+			p.ServiceName = "web"
+			p.EmitTaskEvents = true
+
+			checks := p.checkStoppedTasks("web")
+			var got []string
+			for _, c := range checks {
+				got = append(got, c.name)
+				if (c.err != nil) != (tt.output != "") {
+					t.Errorf("%s: err = %v", c.name, c.err)
+				}
+				if c.err != nil && !strings.Contains(hint(c.name, c.err), tt.output) {
+					t.Errorf("hint of %s = %q, want %s", c.name, hint(c.name, c.err), tt.output)
+				}
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("checks = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,17 @@
+package mpawsecs
+
+import (
+	"fmt"
+	"io"
+	"runtime"
+)
+
+// set by -ldflags at build time
+var (
+	version   = "0.0.0"
+	gitcommit = "unknown"
+)
+
+func printVersion(w io.Writer) {
+	fmt.Fprintf(w, "mackerel-plugin-aws-ecs %s (rev %s) [%s %s %s]\n", version, gitcommit, runtime.GOOS, runtime.GOARCH, runtime.Version())
+}
@@ -0,0 +1,46 @@
+package mpawsecs
+
+import (
+	"log"
+	"strings"
+	"time"
+)
+
+// isTaskRunningKey reports whether key is the running tasks of a service, either of
+// the service itself or nested under its name with multiple services
+func isTaskRunningKey(key string) bool {
+	return key == "TaskRunning" || strings.HasSuffix(key, ".Task.TaskRunning")
+}
+
+// debounceZero leaves out the running tasks of a service reported as 0 until they
+// have been 0 for ZeroGrace, so that a service briefly scaled to zero and back up
+// doesn't alert. The time each one was first seen at 0 is kept in a state file,
+// and dropped once a non-zero value is reported.
+func (p ECSPlugin) debounceZero(stat map[string]float64) {
+	path := p.stateFile("zero-since")
+	zeroSince := make(map[string]time.Time)
+	if err := loadState(path, &zeroSince); err != nil {
+		log.Printf("failed to load the times of the running tasks seen at zero (ignore): %s", err)
+	}
+	now := time.Now()
+	for key, v := range stat {
+		if !isTaskRunningKey(key) {
+			continue
+		}
+		if v != 0 {
+			delete(zeroSince, key)
+			continue
+		}
+		since, ok := zeroSince[key]
+		if !ok {
+			since = now
+			zeroSince[key] = since
+		}
+		if now.Sub(since) < p.ZeroGrace {
+			delete(stat, key)
+		}
+	}
+	if err := saveState(path, zeroSince); err != nil {
+		log.Printf("failed to save the times of the running tasks seen at zero: %s", err)
+	}
+}
@@ -0,0 +1,91 @@
+package mpawsecs
+
+import (
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ecs"
+)
+
+func TestDebounceZero(t *testing.T) {
+	e := &fakeECS{services: map[string]*ecs.Service{"web": newService("web", 0, 0, 0)}}
+	p := newTestPlugin(t, &fakeCloudWatch{}, e)
+	p.ServiceName = "web"
+	p.ZeroGrace = 5 * time.Minute
+	web := e.services["web"]
+
+	// backdate moves the time the service was first seen at zero into the past
+	backdate := func(d time.Duration) {
+		zeroSince := make(map[string]time.Time)
+		if err := loadState(p.stateFile("zero-since"), &zeroSince); err != nil {
+			t.Fatal(err)
+		}
+		for key, since := range zeroSince {
+			zeroSince[key] = since.Add(-d)
+		}
+		if err := saveState(p.stateFile("zero-since"), zeroSince); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name    string
+		running int64
+		before  func()
+		want    bool
+	}{
+		{name: "first seen at zero", running: 0, want: false},
+		{name: "at zero within the grace", running: 0, before: func() { backdate(4 * time.Minute) }, want: false},
+		{name: "at zero for the grace", running: 0, before: func() { backdate(time.Minute) }, want: true},
+		{name: "scaled back up", running: 2, want: true},
+		{name: "at zero again", running: 0, want: false},
+		{name: "at zero again within the grace", running: 0, before: func() { backdate(4 * time.Minute) }, want: false},
+	}
+	for _, tt := range tests {
+		web.RunningCount = aws.Int64(tt.running)
+		if tt.before != nil {
+			tt.before()
+		}
+		stat, err := p.FetchMetrics()
+		if err != nil {
+			t.Fatal(err)
+		}
+		v, ok := stat["TaskRunning"]
+		if ok != tt.want {
+			t.Errorf("%s: TaskRunning reported: %v, want %v", tt.name, ok, tt.want)
+		}
+		if ok && v != float64(tt.running) {
+			t.Errorf("%s: TaskRunning = %v, want %d", tt.name, v, tt.running)
+		}
+		// only the running tasks are debounced
+		if _, ok := stat["TaskDesired"]; !ok {
+			t.Errorf("%s: TaskDesired not reported", tt.name)
+		}
+	}
+}
+
+func TestDebounceZeroOfServices(t *testing.T) {
+	p := newTestPlugin(t, nil, nil)
+	p.ServiceName = "web,worker"
+	p.ZeroGrace = time.Minute
+
+	stat := map[string]float64{
+		"web.Task.TaskRunning":    0,
+		"web.Task.TaskPending":    0,
+		"worker.Task.TaskRunning": 3,
+	}
+	p.debounceZero(stat)
+	want := map[string]float64{
+		"web.Task.TaskPending":    0,
+		"worker.Task.TaskRunning": 3,
+	}
+	if len(stat) != len(want) {
+		t.Fatalf("debounceZero() = %v, want %v", stat, want)
+	}
+	for key, v := range want {
+		if stat[key] != v {
+			t.Errorf("%s = %v, want %v", key, stat[key], v)
+		}
+	}
+}